@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"tailscale.com/client/tailscale/apitype"
+	"time"
+)
+
+// Formats of the access log.
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+var accessLogger = log.New(os.Stdout, "", 0)
+
+type accessLogKey struct{}
+
+// accessEntry holds what the handler learns about a request that the access
+// log middleware can't see by itself.
+type accessEntry struct {
+	user string
+}
+
+// setAccessUser records the tailnet user who sent r for the access log.
+func setAccessUser(r *http.Request, who *apitype.WhoIsResponse) {
+	e, ok := r.Context().Value(accessLogKey{}).(*accessEntry)
+	if !ok || who == nil || who.UserProfile == nil {
+		return
+	}
+	e.user = who.UserProfile.LoginName
+}
+
+// withAccessLog logs every request handled by next in the given format, or
+// returns next as is if format is empty.
+func withAccessLog(format string, next http.Handler) http.Handler {
+	if format == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessEntry{}
+		rw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, e)))
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		logAccess(format, r, e.user, rw.status, rw.size, time.Since(start))
+	})
+}
+
+func logAccess(format string, r *http.Request, user string, status int, size int64, d time.Duration) {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if format == accessLogJSON {
+		b, err := json.Marshal(struct {
+			Time      time.Time `json:"time"`
+			Host      string    `json:"host"`
+			Remote    string    `json:"remote"`
+			User      string    `json:"user,omitempty"`
+			Method    string    `json:"method"`
+			Path      string    `json:"path"`
+			Proto     string    `json:"proto"`
+			Status    int       `json:"status"`
+			Bytes     int64     `json:"bytes"`
+			Duration  float64   `json:"duration_ms"`
+			Referer   string    `json:"referer,omitempty"`
+			UserAgent string    `json:"user_agent,omitempty"`
+		}{time.Now(), r.Host, remote, user, r.Method, r.URL.RequestURI(), r.Proto, status, size, float64(d.Microseconds()) / 1000, r.Referer(), r.UserAgent()})
+		if err != nil {
+			log.Println("failed to encode access log: ", err)
+			return
+		}
+		accessLogger.Println(string(b))
+		return
+	}
+	// Combined Log Format, followed by the host and the duration in
+	// milliseconds.
+	accessLogger.Printf("%s - %s [%s] %q %d %d %q %q %s %d",
+		remote, dash(user), time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto, status, size,
+		dash(r.Referer()), dash(r.UserAgent()), r.Host, d.Milliseconds())
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	// Informational responses precede the final one.
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseAccessLogFormat validates the value of TIC_ACCESS_LOG.
+func parseAccessLogFormat(v string) (string, error) {
+	switch v {
+	case "", accessLogCombined, accessLogJSON:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid TIC_ACCESS_LOG %q, must be %s or %s", v, accessLogCombined, accessLogJSON)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// newAdminServer returns the server for the read-only admin endpoints: probes,
+// metrics and debugging state. It listens on the pod network so that the
+// kubelet and Prometheus can reach it.
+func newAdminServer(addr string, c *controller) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/errors", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.errors.recent()); err != nil {
+			log.Println("failed to encode errors: ", err)
+		}
+	})
+	mux.HandleFunc("/debug/routes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.dumpRoutes()); err != nil {
+			log.Println("failed to encode routes: ", err)
+		}
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if problems := c.readinessProblems(); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// newControlServer returns the server for the endpoints that change the state
+// of the controller. They aren't authenticated, so it listens on localhost by
+// default, where they can be called from a preStop hook.
+func newControlServer(addr string, c *controller) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.setDraining(true)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/undrain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.setDraining(false)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// setDraining toggles whether hosts accept new requests. While draining, new
+// requests are refused with a 503 and keep-alives are disabled so idle clients
+// reconnect and see it, but in-flight requests are left to complete.
+func (c *controller) setDraining(draining bool) {
+	if c.draining.Swap(draining) == draining {
+		return
+	}
+	if draining {
+		log.Println("draining hosts")
+	} else {
+		log.Println("no longer draining hosts")
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for n := range c.nodes {
+		if n.httpServer != nil {
+			n.httpServer.SetKeepAlivesEnabled(!draining)
+		}
+	}
+}
+
+// readinessProblems returns why the controller isn't ready: it hasn't applied
+// an update yet, is shutting down, its auth key was rejected, or has nodes that
+// aren't up.
+func (c *controller) readinessProblems() []string {
+	// Replicas standing by are ready so that they don't hold up rollouts.
+	if c.standby.Load() {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.stopped {
+		return []string{"shutting down"}
+	}
+	if c.authError != "" {
+		return []string{c.authError}
+	}
+	// routes is only set once the first update has been applied.
+	if c.routes == nil {
+		return []string{"no update applied yet"}
+	}
+	var problems []string
+	for n := range c.nodes {
+		switch {
+		case n.failed:
+			problems = append(problems, fmt.Sprintf("node %s failed to come up", n.hostname()))
+		case !n.started:
+			problems = append(problems, fmt.Sprintf("node %s is not started", n.hostname()))
+		case !n.running:
+			problems = append(problems, fmt.Sprintf("node %s is not running yet", n.hostname()))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+type routeDump struct {
+	Host      string     `json:"host"`
+	Node      nodeDump   `json:"node"`
+	Ingresses []string   `json:"ingresses"`
+	Paths     []pathDump `json:"paths"`
+	Default   *pathDump  `json:"default,omitempty"`
+}
+
+type nodeDump struct {
+	Hostname string   `json:"hostname"`
+	Address  string   `json:"address,omitempty"`
+	IPs      []string `json:"ips,omitempty"`
+	TLS      bool     `json:"tls"`
+	Tags     []string `json:"tags,omitempty"`
+	Started  bool     `json:"started"`
+	Running  bool     `json:"running"`
+	Failed   bool     `json:"failed"`
+}
+
+type pathDump struct {
+	Path      string   `json:"path,omitempty"`
+	Type      string   `json:"type,omitempty"`
+	Backend   string   `json:"backend"`
+	Endpoints []string `json:"endpoints,omitempty"`
+	Ingress   string   `json:"ingress"`
+}
+
+// dumpRoutes returns the routing state of every host, with its paths in the
+// order they are matched.
+func (c *controller) dumpRoutes() []routeDump {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	dumps := make([]routeDump, 0, len(c.hosts))
+	for _, name := range sortedKeys(c.hosts) {
+		h := c.hosts[name]
+		d := routeDump{
+			Host: name,
+			Node: nodeDump{
+				Hostname: h.node.hostname(),
+				Address:  h.node.address,
+				IPs:      h.node.ips,
+				TLS:      h.node.useTls,
+				Tags:     h.node.tags,
+				Started:  h.node.started,
+				Running:  h.node.running,
+				Failed:   h.node.failed,
+			},
+			Paths: []pathDump{},
+		}
+		for _, ing := range h.ingresses {
+			d.Ingresses = append(d.Ingresses, fmt.Sprintf("%s/%s (generation %d)", ing.Namespace, ing.Name, ing.Generation))
+		}
+		for _, v := range sortedKeys(h.pathMap) {
+			d.Paths = append(d.Paths, h.pathMap[v].dump())
+		}
+		for _, p := range h.pathPrefixes {
+			d.Paths = append(d.Paths, p.dump())
+		}
+		if h.defaultPath != nil {
+			def := h.defaultPath.dump()
+			def.Path, def.Type = "", ""
+			d.Default = &def
+		}
+		dumps = append(dumps, d)
+	}
+	return dumps
+}
+
+func (p *hostPath) dump() pathDump {
+	d := pathDump{Path: p.value, Type: "prefix", Backend: p.backend.String(), Endpoints: p.endpoints, Ingress: p.source}
+	switch {
+	case p.exact:
+		d.Type = "exact"
+	case p.pattern != nil:
+		d.Type = "regex"
+	}
+	return d
+}
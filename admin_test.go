@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/api/networking/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	svc, eps := testBackend(t, "web", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+	c := newTestController(t, controllerConfig{})
+	c.update(&update{
+		ingresses:      []*v1.Ingress{testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))},
+		services:       []*corev1.Service{svc},
+		endpointSlices: []*discoveryv1.EndpointSlice{eps},
+	})
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+	control := newControlServer("", c).Handler
+	post := func(path string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		control.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("POST %s: got status %d, want %d", path, w.Code, http.StatusNoContent)
+		}
+	}
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	inFlight := make(chan int)
+	go func() {
+		resp, err := http.Get(srv.URL + "/slow")
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+	post("/drain")
+	if code := get("/"); code != http.StatusServiceUnavailable {
+		t.Errorf("new request while draining: got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("in-flight request: got status %d, want %d", code, http.StatusOK)
+	}
+	post("/undrain")
+	if code := get("/"); code != http.StatusOK {
+		t.Errorf("request after undrain: got status %d, want %d", code, http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	control.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/drain", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /drain: got status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	w = httptest.NewRecorder()
+	newAdminServer("", c).Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("POST /drain on the admin server: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDebugErrors(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	serviceErrors := testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues(errorKindService))
+	configErrors := testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues(errorKindConfig))
+	c.update(&update{ingresses: []*v1.Ingress{testIngress("app", "app.example.com",
+		ingressPath("/", v1.PathTypePrefix, "missing"),
+		ingressPath("/(", v1.PathTypeImplementationSpecific, "web"),
+	)}})
+
+	if got := testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues(errorKindService)) - serviceErrors; got != 1 {
+		t.Errorf("got %v service errors counted, want 1", got)
+	}
+	if got := testutil.ToFloat64(reconcileErrorsTotal.WithLabelValues(errorKindConfig)) - configErrors; got != 1 {
+		t.Errorf("got %v config errors counted, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	newAdminServer("", c).Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/errors", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	var errs []reconcileError
+	if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, e := range errs {
+		if e.Host != "app.example.com" {
+			t.Errorf("got error for host %q, want app.example.com", e.Host)
+		}
+		kinds = append(kinds, e.Kind)
+	}
+	if want := []string{errorKindService, errorKindConfig}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got errors of kinds %v, want %v", kinds, want)
+	}
+
+	// Only the most recent errors are kept, oldest first.
+	for i := 0; i < maxRecentErrors+1; i++ {
+		c.recordError(errorKindNode, "", "error %d", i)
+	}
+	errs = c.errors.recent()
+	if len(errs) != maxRecentErrors || errs[0].Message != "error 1" || errs[len(errs)-1].Message != fmt.Sprintf("error %d", maxRecentErrors) {
+		t.Errorf("got %d errors from %q to %q, want the last %d", len(errs), errs[0].Message, errs[len(errs)-1].Message, maxRecentErrors)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const affinityAnnotation = "tailscale.com/affinity"
+
+// Session affinity modes.
+const (
+	// affinityCookie pins a client to the endpoint named by a cookie set on
+	// its first response.
+	affinityCookie = "cookie"
+	// affinityClient pins a tailnet user or tagged device to an endpoint
+	// chosen by hashing its identity.
+	affinityClient = "client"
+)
+
+// affinityCookiePrefix starts the names of the affinity cookies, which are
+// suffixed by a hash of their path: the paths of a host may route to
+// different backends, so sharing a cookie would re-pin clients going back
+// and forth between them.
+const affinityCookiePrefix = "tailscale-affinity-"
+
+func parseAffinity(annotations map[string]string) string {
+	v, ok := annotations[affinityAnnotation]
+	if !ok {
+		return ""
+	}
+	switch v {
+	case affinityCookie, affinityClient:
+		return v
+	}
+	log.Printf("ignoring invalid %s annotation %q", affinityAnnotation, v)
+	return ""
+}
+
+// pickBackend returns the address to send r to, following the session
+// affinity of p, and the cookie to set on the response to pin the client, if
+// any. Without endpoints, requests go to the Service and affinity is left to
+// it.
+func (p *hostPath) pickBackend(r *http.Request, who *apitype.WhoIsResponse, useTls bool) (string, *http.Cookie) {
+	if len(p.endpoints) == 0 {
+		return p.backendHost(), nil
+	}
+	switch p.options.affinity {
+	case affinityClient:
+		return rendezvous(p.endpoints, clientKey(who, r.RemoteAddr)), nil
+	case affinityCookie:
+		name := p.affinityCookieName()
+		if ck, err := r.Cookie(name); err == nil {
+			for _, e := range p.endpoints {
+				if endpointID(e) == ck.Value {
+					return e, nil
+				}
+			}
+		}
+		addr := p.backendHost()
+		return addr, &http.Cookie{
+			Name:     name,
+			Value:    endpointID(addr),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   useTls,
+			SameSite: http.SameSiteLaxMode,
+		}
+	}
+	return p.backendHost(), nil
+}
+
+// affinityCookieName returns the name of the affinity cookie of p.
+func (p *hostPath) affinityCookieName() string {
+	return affinityCookiePrefix + shortHash(p.key())
+}
+
+// endpointID is the opaque cookie value naming an endpoint.
+func endpointID(addr string) string {
+	return shortHash(addr)
+}
+
+// shortHash returns an opaque hash of s that is valid in cookies.
+func shortHash(s string) string {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// rendezvous returns the endpoint with the highest hash for key, so that a key
+// keeps its endpoint as long as it is ready, whatever other endpoints come
+// and go.
+func rendezvous(endpoints []string, key string) string {
+	var best string
+	var bestScore uint64
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e))
+		if s := h.Sum64(); best == "" || s > bestScore {
+			best, bestScore = e, s
+		}
+	}
+	return best
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"k8s.io/api/networking/v1"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"testing"
+)
+
+func TestRendezvous(t *testing.T) {
+	endpoints := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	picked := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		picked[key] = rendezvous(endpoints, key)
+		counts[picked[key]]++
+	}
+	for _, e := range endpoints {
+		if counts[e] < 50 {
+			t.Errorf("endpoint %s picked for %d of 300 keys", e, counts[e])
+		}
+	}
+
+	// Keys only move off an endpoint that goes away, or onto a new one.
+	without := endpoints[1:]
+	with := append([]string{"10.0.0.4:80"}, endpoints...)
+	for key, e := range picked {
+		if got := rendezvous(without, key); e != endpoints[0] && got != e {
+			t.Errorf("%s moved from %s to %s when %s went away", key, e, got, endpoints[0])
+		}
+		if got := rendezvous(with, key); got != e && got != "10.0.0.4:80" {
+			t.Errorf("%s moved from %s to %s when 10.0.0.4:80 was added", key, e, got)
+		}
+	}
+	if got := rendezvous(nil, "user:0"); got != "" {
+		t.Errorf("got endpoint %q without endpoints", got)
+	}
+}
+
+func TestEndpointID(t *testing.T) {
+	a, b := endpointID("10.0.0.1:80"), endpointID("10.0.0.2:80")
+	if a == b {
+		t.Errorf("endpoints got the same ID %s", a)
+	}
+	if endpointID("10.0.0.1:80") != a {
+		t.Error("endpoint ID isn't stable")
+	}
+	if a == "10.0.0.1:80" || url.QueryEscape(a) != a {
+		t.Errorf("endpoint ID %q isn't an opaque cookie value", a)
+	}
+}
+
+func TestPickBackend(t *testing.T) {
+	endpoints := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"}
+	p := &hostPath{
+		backend:   &url.URL{Host: "web.default.svc:80"},
+		endpoints: endpoints,
+		options:   &pathOptions{affinity: affinityCookie},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	addr, ck := p.pickBackend(r, nil, true)
+	if ck == nil || ck.Name != p.affinityCookieName() || ck.Value != endpointID(addr) || !ck.Secure || !ck.HttpOnly {
+		t.Fatalf("got cookie %v for %s, want a secure affinity cookie naming it", ck, addr)
+	}
+	// The cookie pins the client to its endpoint, over round-robin.
+	for i := 0; i < len(endpoints); i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(&http.Cookie{Name: p.affinityCookieName(), Value: ck.Value})
+		got, gotCookie := p.pickBackend(r, nil, true)
+		if got != addr || gotCookie != nil {
+			t.Errorf("got %s and cookie %v with the cookie of %s", got, gotCookie, addr)
+		}
+	}
+	// A client whose endpoint went away is pinned to another one.
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: p.affinityCookieName(), Value: endpointID("10.0.0.9:80")})
+	if got, ck := p.pickBackend(r, nil, false); ck == nil || ck.Value != endpointID(got) || ck.Secure {
+		t.Errorf("got cookie %v for %s after its endpoint went away", ck, got)
+	}
+
+	p.options.affinity = affinityClient
+	who := &apitype.WhoIsResponse{UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com"}}
+	var first string
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = fmt.Sprintf("100.64.0.%d:1234", i+1)
+		got, ck := p.pickBackend(r, who, false)
+		if ck != nil {
+			t.Errorf("got cookie %v with client affinity", ck)
+		}
+		if i == 0 {
+			first = got
+		} else if got != first {
+			t.Errorf("user moved from %s to %s", first, got)
+		}
+	}
+
+	p.endpoints = nil
+	if got, ck := p.pickBackend(r, who, false); got != "web.default.svc:80" || ck != nil {
+		t.Errorf("got %s and cookie %v without endpoints, want the Service", got, ck)
+	}
+}
+
+func TestAffinityPerPath(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com",
+		ingressPath("/a", v1.PathTypePrefix, "a"),
+		ingressPath("/b", v1.PathTypePrefix, "b"),
+	)
+	ing.Annotations = map[string]string{affinityAnnotation: affinityCookie}
+	u := &update{ingresses: []*v1.Ingress{ing}}
+	// Each Service has three pods, which respond with their name.
+	for _, svc := range []string{"a", "b"} {
+		u.services = append(u.services, testService(svc))
+		for i := 0; i < 3; i++ {
+			pod := fmt.Sprintf("%s-%d", svc, i)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, pod)
+			}))
+			t.Cleanup(srv.Close)
+			u.endpointSlices = append(u.endpointSlices, testEndpoints(svc, srv.Listener.Addr().(*net.TCPAddr).Port))
+		}
+	}
+	c.update(u)
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+
+	pinned := make(map[string]string)
+	for i := 0; i < 6; i++ {
+		for _, path := range []string{"/a", "/b"} {
+			resp, err := client.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			setsCookie := len(resp.Cookies()) > 0
+			if got := string(b); pinned[path] == "" {
+				if !setsCookie {
+					t.Errorf("%s: got no affinity cookie on the first response", path)
+				}
+				pinned[path] = got
+			} else if got != pinned[path] || setsCookie {
+				t.Errorf("%s: request %d went to %s, setting a cookie %t, want %s and no cookie", path, i+1, got, setsCookie, pinned[path])
+			}
+		}
+	}
+	if got := len(jar.Cookies(mustParseURL(t, srv.URL))); got != 2 {
+		t.Errorf("got %d cookies, want one per path", got)
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// boolAnnotation returns the boolean value of an annotation, or def if it is
+// unset or invalid.
+func boolAnnotation(annotations map[string]string, name string, def bool) bool {
+	v, ok := annotations[name]
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("ignoring invalid %s annotation %q", name, v)
+		return def
+	}
+	return b
+}
+
+// setAnnotation returns the values of a comma-separated annotation as a set,
+// or nil if it is unset.
+func setAnnotation(annotations map[string]string, name string) map[string]struct{} {
+	v, ok := annotations[name]
+	if !ok {
+		return nil
+	}
+	set := make(map[string]struct{})
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			set[e] = struct{}{}
+		}
+	}
+	return set
+}
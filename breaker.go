@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	circuitBreakerFailuresAnnotation = "tailscale.com/circuit-breaker-failures"
+	circuitBreakerCooldownAnnotation = "tailscale.com/circuit-breaker-cooldown"
+)
+
+// errCircuitOpen is returned instead of sending a request to a backend whose
+// circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerKey identifies the circuit breaker of a backend of an Ingress.
+type breakerKey struct {
+	uid     types.UID
+	backend string
+}
+
+// circuitBreaker stops sending requests to a backend after a number of
+// consecutive failures, failing them right away until the cooldown is over.
+// Then a single request is let through, which closes the breaker if it
+// succeeds and opens it again otherwise. It is kept across updates as long as
+// its failures and cooldown stay the same; annotation changes don't bump the
+// Ingress generation.
+type circuitBreaker struct {
+	failures int
+	cooldown time.Duration
+	ingress  string
+	backend  string
+
+	mu       sync.Mutex
+	state    breakerState
+	failed   int
+	openedAt time.Time
+}
+
+// allow reports whether a request may be sent to the backend.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// The probe request is still in flight.
+		return false
+	}
+	return true
+}
+
+// done records the outcome of a request allowed by allow.
+func (b *circuitBreaker) done(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.failed = 0
+		if b.state != breakerClosed {
+			log.Printf("closing circuit breaker of backend %s of ingress %s", b.backend, b.ingress)
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failed++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failed >= b.failures) {
+		if b.state == breakerClosed {
+			log.Printf("opening circuit breaker of backend %s of ingress %s after %d failures", b.backend, b.ingress, b.failed)
+		}
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// release ends a request allowed by allow without recording an outcome. A
+// half-open breaker lets the next request probe the backend.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state and updates the metric. b.mu must be held.
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	circuitBreakerState.WithLabelValues(b.ingress, b.backend).Set(float64(s))
+}
+
+// breakerTransport fails requests right away while the breaker is open.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.breaker.allow() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errCircuitOpen
+	}
+	var body *clientBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &clientBody{ReadCloser: req.Body}
+		r := new(http.Request)
+		*r = *req
+		r.Body = body
+		req = r
+	}
+	resp, err := t.next.RoundTrip(req)
+	// Requests canceled by the client, or whose body couldn't be read from
+	// it or exceeded the limit, say nothing about the backend.
+	if err != nil && (req.Context().Err() != nil || (body != nil && body.failed.Load())) {
+		t.breaker.release()
+		return resp, err
+	}
+	t.breaker.done(err == nil && !backendUnavailable(resp.StatusCode))
+	return resp, err
+}
+
+// clientBody records whether reading the request body from the client failed.
+type clientBody struct {
+	io.ReadCloser
+	failed atomic.Bool
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.failed.Store(true)
+	}
+	return n, err
+}
+
+// backendUnavailable reports whether a response status code means the backend
+// couldn't handle the request, rather than rejected it.
+func backendUnavailable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// withBreaker wraps t in a breakerTransport for the backend if the annotations
+// of the Ingress enable the circuit breaker, reusing the breaker of the
+// previous update unless its failures or cooldown changed. The breakers in use
+// are added to next. c.mu must be held for writing.
+func (c *controller) withBreaker(t http.RoundTripper, ingress *v1.Ingress, backend string, next map[breakerKey]*circuitBreaker) http.RoundTripper {
+	v, ok := ingress.Annotations[circuitBreakerFailuresAnnotation]
+	if !ok {
+		return t
+	}
+	failures, err := strconv.Atoi(v)
+	if err != nil || failures < 1 {
+		log.Printf("ignoring invalid %s annotation %q", circuitBreakerFailuresAnnotation, v)
+		return t
+	}
+	cooldown := 30 * time.Second
+	if v, ok := ingress.Annotations[circuitBreakerCooldownAnnotation]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("ignoring invalid %s annotation %q", circuitBreakerCooldownAnnotation, v)
+		} else {
+			cooldown = d
+		}
+	}
+	k := breakerKey{ingress.UID, backend}
+	b, ok := next[k]
+	if !ok {
+		b, ok = c.breakers[k]
+		if !ok || b.failures != failures || b.cooldown != cooldown {
+			b = &circuitBreaker{
+				failures: failures,
+				cooldown: cooldown,
+				ingress:  ingress.Namespace + "/" + ingress.Name,
+				backend:  backend,
+			}
+			b.setState(breakerClosed)
+		}
+		next[k] = b
+	}
+	return &breakerTransport{next: t, breaker: b}
+}
+
+// setBreakers replaces the breakers in use, removing the metrics of the
+// unused ones. c.mu must be held for writing.
+func (c *controller) setBreakers(next map[breakerKey]*circuitBreaker) {
+	for k, b := range c.breakers {
+		if _, ok := next[k]; !ok {
+			circuitBreakerState.DeleteLabelValues(b.ingress, b.backend)
+		}
+	}
+	c.breakers = next
+}
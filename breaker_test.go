@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var code int
+	var err error
+	backend := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Body != nil {
+			if _, readErr := io.ReadAll(req.Body); readErr != nil {
+				return nil, readErr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+	})
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com")
+	ing.Annotations = map[string]string{
+		circuitBreakerFailuresAnnotation: "2",
+		circuitBreakerCooldownAnnotation: "50ms",
+	}
+	next := make(map[breakerKey]*circuitBreaker)
+	rt := c.withBreaker(backend, ing, "web", next)
+	c.setBreakers(next)
+	b := next[breakerKey{ing.UID, "web"}]
+	send := func(body io.Reader) error {
+		req := httptest.NewRequest(http.MethodPost, "http://web/", body)
+		resp, err := rt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	state := func() breakerState {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.state
+	}
+
+	// Client errors and request body errors don't count.
+	code = http.StatusInternalServerError
+	for i := 0; i < 3; i++ {
+		send(nil)
+	}
+	code = http.StatusOK
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large"))
+		send(http.MaxBytesReader(w, r.Body, 1))
+		send(io.MultiReader(strings.NewReader("a"), errReader{errors.New("client went away")}))
+	}
+	if s := state(); s != breakerClosed {
+		t.Fatalf("got state %d after client errors, want closed", s)
+	}
+
+	code = http.StatusBadGateway
+	send(nil)
+	err = errors.New("connection refused")
+	send(nil)
+	if s := state(); s != breakerOpen {
+		t.Fatalf("got state %d after 2 failures, want open", s)
+	}
+	err = nil
+	code = http.StatusOK
+	if e := send(nil); !errors.Is(e, errCircuitOpen) {
+		t.Fatalf("got error %v while open, want %v", e, errCircuitOpen)
+	}
+
+	// After the cooldown a failed probe opens the breaker again and a
+	// successful one closes it.
+	time.Sleep(60 * time.Millisecond)
+	code = http.StatusGatewayTimeout
+	send(nil)
+	if s := state(); s != breakerOpen {
+		t.Fatalf("got state %d after a failed probe, want open", s)
+	}
+	time.Sleep(60 * time.Millisecond)
+	code = http.StatusOK
+	if e := send(nil); e != nil {
+		t.Fatalf("probe failed: %v", e)
+	}
+	if s := state(); s != breakerClosed {
+		t.Fatalf("got state %d after a successful probe, want closed", s)
+	}
+
+	// The breaker is kept until its settings change.
+	reuse := func() *circuitBreaker {
+		next := make(map[breakerKey]*circuitBreaker)
+		c.withBreaker(backend, ing, "web", next)
+		c.setBreakers(next)
+		return next[breakerKey{ing.UID, "web"}]
+	}
+	if reuse() != b {
+		t.Error("breaker with the same settings wasn't reused")
+	}
+	ing.Annotations[circuitBreakerCooldownAnnotation] = "1m"
+	if reuse() == b {
+		t.Error("breaker was reused after the cooldown changed")
+	}
+	ing.Annotations = map[string]string{circuitBreakerFailuresAnnotation: "5"}
+	b = reuse()
+	ing.Annotations[circuitBreakerFailuresAnnotation] = "3"
+	if reuse() == b {
+		t.Error("breaker was reused after the failures changed")
+	}
+	ing.Annotations = nil
+	if reuse() != nil || len(c.breakers) != 0 {
+		t.Error("breaker kept after its annotation was removed")
+	}
+}
+
+// errReader fails every read with err.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
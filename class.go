@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log"
+)
+
+// controllerName is the spec.controller of the IngressClasses handled by the
+// controller.
+const controllerName = "tailscale.com/ts-ingress"
+
+const legacyIngressClassAnnotation = "kubernetes.io/ingress.class"
+
+// ourClasses returns the class names of the ingresses handled by the
+// controller: the configured class and those of IngressClasses naming the
+// controller, plus the empty class if such an IngressClass is the default one
+// or if there is no default IngressClass at all, as ingresses without a class
+// were handled before IngressClasses were.
+func (c controllerConfig) ourClasses(classes []*v1.IngressClass) map[string]bool {
+	ours := map[string]bool{c.ingressClass: true}
+	hasDefault := false
+	for _, ic := range classes {
+		isDefault := ic.Annotations[v1.AnnotationIsDefaultIngressClass] == "true"
+		hasDefault = hasDefault || isDefault
+		if ic.Spec.Controller != controllerName {
+			continue
+		}
+		ours[ic.Name] = true
+		if isDefault {
+			ours[""] = true
+		}
+	}
+	if !hasDefault {
+		ours[""] = true
+	}
+	return ours
+}
+
+// canListIngressClasses reports whether the controller may list
+// IngressClasses. They are cluster-scoped, so a controller watching a single
+// namespace with a Role may not, in which case ingresses are matched by class
+// name only; waiting for their informer to sync would block forever.
+func canListIngressClasses(ctx context.Context, client kubernetes.Interface) bool {
+	_, err := client.NetworkingV1().IngressClasses().List(ctx, metav1.ListOptions{Limit: 1})
+	if apierrors.IsForbidden(err) {
+		log.Printf("not watching IngressClasses, which the controller may not list: %v", err)
+		return false
+	}
+	return true
+}
+
+// ingressClassName returns the class of ing, from its spec or the legacy
+// annotation.
+func ingressClassName(ing *v1.Ingress) string {
+	if ing.Spec.IngressClassName != nil {
+		return *ing.Spec.IngressClassName
+	}
+	return ing.Annotations[legacyIngressClassAnnotation]
+}
+
+// filterIngresses returns the ingresses handled by the controller.
+func (c controllerConfig) filterIngresses(ingresses []*v1.Ingress, classes []*v1.IngressClass) []*v1.Ingress {
+	ours := c.ourClasses(classes)
+	var filtered []*v1.Ingress
+	for _, ing := range ingresses {
+		class := ingressClassName(ing)
+		if !ours[class] {
+			if class == "" {
+				log.Printf("ignoring ingress %s/%s without a class", ing.Namespace, ing.Name)
+			}
+			continue
+		}
+		filtered = append(filtered, ing)
+	}
+	return filtered
+}
+
+// referencesService reports whether ing routes to the service name in its
+// namespace.
+func referencesService(ing *v1.Ingress, name string) bool {
+	if b := ing.Spec.DefaultBackend; b != nil && b.Service != nil && b.Service.Name == name {
+		return true
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			if p.Backend.Service != nil && p.Backend.Service.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+	"time"
+)
+
+func TestClasslessIngresses(t *testing.T) {
+	ingressClass := func(name, controller string, isDefault bool) *v1.IngressClass {
+		ic := &v1.IngressClass{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.IngressClassSpec{Controller: controller},
+		}
+		if isDefault {
+			ic.Annotations = map[string]string{v1.AnnotationIsDefaultIngressClass: "true"}
+		}
+		return ic
+	}
+	for _, tt := range []struct {
+		name    string
+		classes []*v1.IngressClass
+		want    bool
+	}{
+		{"no IngressClass", nil, true},
+		{"no default IngressClass", []*v1.IngressClass{ingressClass("nginx", "k8s.io/ingress-nginx", false)}, true},
+		{"our default IngressClass", []*v1.IngressClass{
+			ingressClass("nginx", "k8s.io/ingress-nginx", false),
+			ingressClass("tailscale", controllerName, true),
+		}, true},
+		{"default IngressClass of another controller", []*v1.IngressClass{
+			ingressClass("nginx", "k8s.io/ingress-nginx", true),
+			ingressClass("tailscale", controllerName, false),
+		}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := controllerConfig{ingressClass: "tailscale"}
+			ing := testIngress("app", "app.example.com")
+			ing.Spec.IngressClassName = nil
+			got := len(cfg.filterIngresses([]*v1.Ingress{ing}, tt.classes)) == 1
+			if got != tt.want {
+				t.Errorf("ingress without a class handled: %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngressClassesForbidden(t *testing.T) {
+	ours := &v1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "internal"},
+		Spec:       v1.IngressClassSpec{Controller: controllerName},
+	}
+	for _, forbidden := range []bool{false, true} {
+		client := fake.NewSimpleClientset(ours)
+		if forbidden {
+			// As with a Role only granting access to the watched namespace.
+			client.PrependReactor("*", "ingressclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, apierrors.NewForbidden(v1.Resource("ingressclasses"), "", errors.New("cluster-scoped"))
+			})
+		}
+		cfg := controllerConfig{ingressClass: "tailscale", watchNamespace: "default", reconcileDebounce: time.Millisecond}
+		ctx, cancel := context.WithCancel(context.Background())
+		updates := make(chan *update, 1)
+		go listen(ctx, client, nil, cfg, func(u *update) {
+			select {
+			case updates <- u:
+			default:
+			}
+		})
+		select {
+		case u := <-updates:
+			// Without IngressClasses, only the configured class is handled.
+			wantClasses, wantIngresses := 1, 2
+			if forbidden {
+				wantClasses, wantIngresses = 0, 1
+			}
+			if got := len(u.ingressClasses); got != wantClasses {
+				t.Errorf("forbidden %t: got %d IngressClasses, want %d", forbidden, got, wantClasses)
+			}
+			ingresses := []*v1.Ingress{testIngress("app", "app.example.com"), testIngress("internal", "internal.example.com")}
+			ingresses[1].Spec.IngressClassName = &ours.Name
+			if got := len(cfg.filterIngresses(ingresses, u.ingressClasses)); got != wantIngresses {
+				t.Errorf("forbidden %t: got %d ingresses handled, want %d", forbidden, got, wantIngresses)
+			}
+		case <-time.After(10 * time.Second):
+			t.Errorf("forbidden %t: timed out waiting for the caches to sync", forbidden)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runStatus implements the status subcommand, which prints the routes of a
+// running controller, read from its admin server, and returns the exit code.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:9090", "address of the admin server of the controller")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + *addr + "/debug/routes")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to get routes:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		fmt.Fprintf(os.Stderr, "failed to get routes: %s: %s\n", resp.Status, strings.TrimSpace(string(msg)))
+		return 1
+	}
+	var dumps []routeDump
+	if err := json.NewDecoder(resp.Body).Decode(&dumps); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to decode routes:", err)
+		return 1
+	}
+	printRoutes(os.Stdout, dumps)
+	return 0
+}
+
+// printRoutes prints a table with a row per path of every host.
+func printRoutes(out io.Writer, dumps []routeDump) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tNODE\tIPS\tTLS\tSTATE\tPATH\tBACKEND")
+	for _, d := range dumps {
+		state := "starting"
+		switch {
+		case d.Node.Failed:
+			state = "failed"
+		case d.Node.Running:
+			state = "running"
+		case !d.Node.Started:
+			state = "pending"
+		}
+		node := d.Node.Address
+		if node == "" {
+			node = d.Node.Hostname
+		}
+		paths := d.Paths
+		if d.Default != nil {
+			def := *d.Default
+			def.Path = "(default)"
+			paths = append(paths, def)
+		}
+		if len(paths) == 0 {
+			paths = []pathDump{{Backend: "-"}}
+		}
+		for _, p := range paths {
+			path := p.Path
+			if p.Type != "" {
+				path += " (" + p.Type + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\t%s\n", d.Host, node, dash(strings.Join(d.Node.IPs, ",")), d.Node.TLS, state, dash(path), p.Backend)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	compressAnnotation        = "tailscale.com/compress-responses"
+	compressMinSizeAnnotation = "tailscale.com/compress-min-size"
+)
+
+const defaultCompressMinSize = 1 << 10
+
+// compressMinSize returns the smallest response body compressed for an
+// Ingress, or -1 if compression is disabled.
+func compressMinSize(annotations map[string]string) int64 {
+	if !boolAnnotation(annotations, compressAnnotation, false) {
+		return -1
+	}
+	v, ok := annotations[compressMinSizeAnnotation]
+	if !ok {
+		return defaultCompressMinSize
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		log.Printf("ignoring invalid %s annotation %q: %v", compressMinSizeAnnotation, v, err)
+		return defaultCompressMinSize
+	}
+	return n
+}
+
+// compressResponse gzips the body of resp if the client accepts it and the
+// body is worth compressing: not already compressed, not a streamed event
+// source and, if its length is known, at least minSize bytes.
+func compressResponse(resp *http.Response, minSize int64) {
+	if !acceptsGzip(resp.Request.Header) ||
+		resp.Request.Method == http.MethodHead ||
+		resp.StatusCode < 200 || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !compressible(mediaType) {
+		return
+	}
+	pr, pw := io.Pipe()
+	resp.Body = &gzipBody{body: resp.Body, pr: pr, pw: pw}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	// The compressed body is no longer byte for byte the one the backend
+	// tagged.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// gzipBody compresses a response body as it is read. The body is only read
+// from once the proxy starts copying the response: reading it to the end sets
+// the trailers of the response, which the proxy looks at before that.
+type gzipBody struct {
+	body io.ReadCloser
+	once sync.Once
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	b.once.Do(func() { go b.compress() })
+	return b.pr.Read(p)
+}
+
+func (b *gzipBody) compress() {
+	defer b.body.Close()
+	gw := gzip.NewWriter(b.pw)
+	_, err := io.Copy(gw, b.body)
+	if err == nil {
+		err = gw.Close()
+	}
+	b.pw.CloseWithError(err)
+}
+
+func (b *gzipBody) Close() error {
+	// Once compressing, the body is closed when writing to the pipe fails.
+	b.once.Do(func() { b.body.Close() })
+	return b.pr.Close()
+}
+
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h.Values("Accept-Encoding") {
+		for _, e := range strings.Split(v, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(e), ";")
+			if strings.EqualFold(strings.TrimSpace(coding), "gzip") && qvalue(params) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// qvalue returns the weight in the parameters of an Accept-Encoding element,
+// 1 if there is none and 0 if it is invalid.
+func qvalue(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(p, "=")
+		if !strings.EqualFold(strings.TrimSpace(k), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
+
+// compressible reports whether a media type benefits from compression; media
+// and archives are usually compressed already.
+func compressible(mediaType string) bool {
+	switch {
+	case mediaType == "":
+		return false
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"):
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm":
+		return true
+	}
+	return false
+}
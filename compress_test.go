@@ -0,0 +1,177 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressible(t *testing.T) {
+	for mediaType, want := range map[string]bool{
+		"":                         false,
+		"text/html":                true,
+		"text/plain":               true,
+		"text/event-stream":        false,
+		"application/json":         true,
+		"application/ld+json":      true,
+		"application/atom+xml":     true,
+		"application/javascript":   true,
+		"application/wasm":         true,
+		"application/zip":          false,
+		"application/octet-stream": false,
+		"image/svg+xml":            true,
+		"image/png":                false,
+		"video/mp4":                false,
+		"audio/ogg":                false,
+	} {
+		if got := compressible(mediaType); got != want {
+			t.Errorf("compressible(%q) = %t, want %t", mediaType, got, want)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for v, want := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"GZIP":                true,
+		"deflate, gzip;q=0.5": true,
+		"br, gzip ; q=0":      false,
+		"gzip;q=0":            false,
+		"gzip;q=0.0":          false,
+		"gzip; Q=0.000":       false,
+		"gzip;q=0.001":        true,
+		"gzip;q=invalid":      false,
+		"gzip;level=1;q=1.0":  true,
+		"identity":            false,
+		"*":                   false,
+	} {
+		h := http.Header{}
+		if v != "" {
+			h.Set("Accept-Encoding", v)
+		}
+		if got := acceptsGzip(h); got != want {
+			t.Errorf("acceptsGzip(%q) = %t, want %t", v, got, want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("hello ", 100)
+	for _, tt := range []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		code           int
+		contentType    string
+		encoding       string
+		length         int64
+		want           bool
+	}{
+		{"text", http.MethodGet, "gzip", http.StatusOK, "text/html; charset=utf-8", "", int64(len(body)), true},
+		{"unknown length", http.MethodGet, "gzip", http.StatusOK, "application/json", "", -1, true},
+		{"not accepted", http.MethodGet, "br", http.StatusOK, "text/html", "", int64(len(body)), false},
+		{"head", http.MethodHead, "gzip", http.StatusOK, "text/html", "", int64(len(body)), false},
+		{"no content", http.MethodGet, "gzip", http.StatusNoContent, "text/html", "", -1, false},
+		{"partial content", http.MethodGet, "gzip", http.StatusPartialContent, "text/html", "", int64(len(body)), false},
+		{"not modified", http.MethodGet, "gzip", http.StatusNotModified, "text/html", "", -1, false},
+		{"already encoded", http.MethodGet, "gzip", http.StatusOK, "text/html", "br", int64(len(body)), false},
+		{"too small", http.MethodGet, "gzip", http.StatusOK, "text/html", "", 100, false},
+		{"image", http.MethodGet, "gzip", http.StatusOK, "image/png", "", int64(len(body)), false},
+		{"event stream", http.MethodGet, "gzip", http.StatusOK, "text/event-stream", "", -1, false},
+	} {
+		req, err := http.NewRequest(tt.method, "http://app.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		resp := &http.Response{
+			StatusCode:    tt.code,
+			Header:        http.Header{"Content-Type": {tt.contentType}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: tt.length,
+			Request:       req,
+		}
+		if tt.encoding != "" {
+			resp.Header.Set("Content-Encoding", tt.encoding)
+		}
+		if tt.length >= 0 {
+			resp.Header.Set("Content-Length", "0")
+		}
+		compressResponse(resp, 512)
+
+		if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.want {
+			t.Errorf("%s: got compressed %t, want %t", tt.name, got, tt.want)
+			continue
+		}
+		if !tt.want {
+			continue
+		}
+		if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+			t.Errorf("%s: got a content length on a compressed body", tt.name)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: got Vary %q, want Accept-Encoding", tt.name, got)
+		}
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b, err := io.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(b) != body {
+			t.Errorf("%s: got a body of %d bytes, want %d", tt.name, len(b), len(body))
+		}
+	}
+}
+
+func TestCompressETag(t *testing.T) {
+	body := strings.Repeat("hello ", 100)
+	for _, tt := range []struct {
+		acceptEncoding string
+		etag           string
+		want           string
+	}{
+		{"gzip", `"v1"`, `W/"v1"`},
+		{"gzip", `W/"v1"`, `W/"v1"`},
+		{"identity", `"v1"`, `"v1"`},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {"text/html"}, "Etag": {tt.etag}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+		compressResponse(resp, 512)
+		if got := resp.Header.Get("ETag"); got != tt.want {
+			t.Errorf("ETag %s with Accept-Encoding %q: got %s, want %s", tt.etag, tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompressMinSize(t *testing.T) {
+	for _, tt := range []struct {
+		annotations map[string]string
+		want        int64
+	}{
+		{nil, -1},
+		{map[string]string{compressAnnotation: "false", compressMinSizeAnnotation: "1"}, -1},
+		{map[string]string{compressAnnotation: "true"}, defaultCompressMinSize},
+		{map[string]string{compressAnnotation: "true", compressMinSizeAnnotation: "4k"}, 4 << 10},
+		{map[string]string{compressAnnotation: "true", compressMinSizeAnnotation: "invalid"}, defaultCompressMinSize},
+	} {
+		if got := compressMinSize(tt.annotations); got != tt.want {
+			t.Errorf("compressMinSize(%v) = %d, want %d", tt.annotations, got, tt.want)
+		}
+	}
+}
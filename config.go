@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"k8s.io/api/networking/v1"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// controllerConfig holds the controller-wide settings read from the
+// environment.
+type controllerConfig struct {
+	tsAuthKey              string
+	tsAPIKey               string
+	tailnet                string
+	ephemeral              bool
+	timeouts               timeouts
+	defaultPathType        v1.PathType
+	adminAddr              string
+	controlAddr            string
+	maxResponseHeaderBytes int64
+	whoIsTimeout           time.Duration
+	requireIdentity        bool
+	provisionTimeout       time.Duration
+	headerLimits           headerLimits
+	sharedNodeEnabled      bool
+	sharedNodeHostname     string
+	shutdownTimeout        time.Duration
+	// watchNamespace restricts the controller to one namespace if set.
+	watchNamespace string
+	leaderElection bool
+	// ingressClass is the class name of the ingresses handled by the
+	// controller, besides those of IngressClasses naming it.
+	ingressClass string
+	// reconcileDebounce is how long to wait for events to settle before
+	// reconciling.
+	reconcileDebounce time.Duration
+	// transportOptions are the defaults for connecting to backends.
+	transportOptions transportOptions
+	// oauthClientID and oauthClientSecret are the credentials of an OAuth
+	// client used to create an auth key for every node, instead of tsAuthKey.
+	oauthClientID     string
+	oauthClientSecret string
+	// oauthTags are the tags of the nodes whose ingress has no tags
+	// annotation, when auth keys are created.
+	oauthTags []string
+	// stateDir is the directory holding the state directories of the nodes,
+	// under the user config dir if empty.
+	stateDir string
+	// accessLog is the format of the access log, which is disabled if empty.
+	accessLog string
+	// resolveClusterIP makes HTTP backends without ready endpoints be
+	// reached at the ClusterIP of their Service rather than its DNS name.
+	resolveClusterIP bool
+	// statusAddress is the TIC_STATUS_ADDRESS mode: which addresses of the
+	// nodes are written to the ingress status.
+	statusAddress string
+	// gatewayAPI enables the translation of Gateway API HTTPRoutes.
+	gatewayAPI bool
+	// dryRun makes the controller reconcile once and log the resulting routes
+	// without starting any node or writing to the cluster.
+	dryRun bool
+}
+
+func configFromEnv() (controllerConfig, error) {
+	var cfg controllerConfig
+	var err error
+
+	if v := os.Getenv("DRY_RUN"); v != "" {
+		if cfg.dryRun, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid DRY_RUN %q", v)
+		}
+	}
+
+	cfg.oauthClientID = os.Getenv("TS_OAUTH_CLIENT_ID")
+	cfg.oauthClientSecret = strings.TrimSpace(os.Getenv("TS_OAUTH_CLIENT_SECRET"))
+	if (cfg.oauthClientID == "") != (cfg.oauthClientSecret == "") {
+		return cfg, errors.New("TS_OAUTH_CLIENT_ID and TS_OAUTH_CLIENT_SECRET must be set together")
+	}
+	cfg.oauthTags = parseTags(os.Getenv("TS_OAUTH_TAGS"))
+	if cfg.oauthClientID != "" && len(cfg.oauthTags) == 0 {
+		return cfg, errors.New("missing TS_OAUTH_TAGS, which auth keys created by OAuth clients require")
+	}
+
+	cfg.tsAuthKey = os.Getenv("TS_AUTHKEY")
+	if cfg.tsAuthKey == "" && cfg.oauthClientID == "" && !cfg.dryRun {
+		return cfg, errors.New("missing TS_AUTHKEY or TS_OAUTH_CLIENT_ID")
+	}
+	// Keys pasted into a Secret often carry a trailing newline.
+	cfg.tsAuthKey = strings.TrimSpace(cfg.tsAuthKey)
+	if cfg.tsAuthKey != "" && !strings.HasPrefix(cfg.tsAuthKey, "tskey-") {
+		return cfg, errors.New("invalid TS_AUTHKEY: auth keys start with tskey-")
+	}
+
+	cfg.tsAPIKey = os.Getenv("TS_API_KEY")
+	cfg.tailnet = os.Getenv("TS_TAILNET")
+	if cfg.tailnet == "" {
+		cfg.tailnet = "-"
+	}
+
+	cfg.ephemeral = true
+	if v := os.Getenv("TS_EPHEMERAL"); v != "" {
+		if cfg.ephemeral, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid TS_EPHEMERAL %q", v)
+		}
+	}
+
+	cfg.stateDir = os.Getenv("TS_STATE_DIR")
+
+	if cfg.accessLog, err = parseAccessLogFormat(os.Getenv("TIC_ACCESS_LOG")); err != nil {
+		return cfg, err
+	}
+
+	if cfg.timeouts, err = timeoutsFromEnv(); err != nil {
+		return cfg, err
+	}
+
+	cfg.defaultPathType = v1.PathTypePrefix
+	if v := os.Getenv("TIC_DEFAULT_PATH_TYPE"); v != "" {
+		switch t := v1.PathType(v); t {
+		case v1.PathTypePrefix, v1.PathTypeExact, v1.PathTypeImplementationSpecific:
+			cfg.defaultPathType = t
+		default:
+			return cfg, fmt.Errorf("invalid TIC_DEFAULT_PATH_TYPE %q", v)
+		}
+	}
+
+	if cfg.transportOptions, err = transportOptionsFromEnv(); err != nil {
+		return cfg, err
+	}
+
+	if v := os.Getenv("TIC_MAX_RESPONSE_HEADER_BYTES"); v != "" {
+		cfg.maxResponseHeaderBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || cfg.maxResponseHeaderBytes < 0 {
+			return cfg, fmt.Errorf("invalid TIC_MAX_RESPONSE_HEADER_BYTES %q", v)
+		}
+	}
+
+	if cfg.whoIsTimeout, err = durationFromEnv("TIC_WHOIS_TIMEOUT", 2*time.Second); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("TIC_REQUIRE_IDENTITY"); v != "" {
+		if cfg.requireIdentity, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid TIC_REQUIRE_IDENTITY %q", v)
+		}
+	}
+
+	if cfg.provisionTimeout, err = durationFromEnv("TIC_HOST_PROVISION_TIMEOUT", 5*time.Minute); err != nil {
+		return cfg, err
+	}
+
+	if cfg.headerLimits, err = headerLimitsFromEnv(); err != nil {
+		return cfg, err
+	}
+
+	if v := os.Getenv("TS_SHARED_NODE"); v != "" {
+		if cfg.sharedNodeEnabled, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid TS_SHARED_NODE %q", v)
+		}
+	}
+	cfg.sharedNodeHostname = os.Getenv("TS_SHARED_NODE_HOSTNAME")
+	if cfg.sharedNodeHostname == "" {
+		cfg.sharedNodeHostname = "tailscale-ingress"
+	}
+
+	if cfg.shutdownTimeout, err = durationFromEnv("TS_SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return cfg, err
+	}
+
+	if v := os.Getenv("ENABLE_LEADER_ELECTION"); v != "" {
+		if cfg.leaderElection, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid ENABLE_LEADER_ELECTION %q", v)
+		}
+	}
+
+	cfg.watchNamespace = os.Getenv("WATCH_NAMESPACE")
+
+	if cfg.statusAddress, err = parseStatusAddress(os.Getenv("TIC_STATUS_ADDRESS")); err != nil {
+		return cfg, err
+	}
+
+	if v := os.Getenv("TIC_RESOLVE_CLUSTER_IP"); v != "" {
+		if cfg.resolveClusterIP, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid TIC_RESOLVE_CLUSTER_IP %q", v)
+		}
+	}
+
+	if v := os.Getenv("ENABLE_GATEWAY_API"); v != "" {
+		if cfg.gatewayAPI, err = strconv.ParseBool(v); err != nil {
+			return cfg, fmt.Errorf("invalid ENABLE_GATEWAY_API %q", v)
+		}
+	}
+
+	if cfg.reconcileDebounce, err = durationFromEnv("RECONCILE_DEBOUNCE", time.Second); err != nil {
+		return cfg, err
+	}
+
+	cfg.ingressClass = os.Getenv("INGRESS_CLASS")
+	if cfg.ingressClass == "" {
+		cfg.ingressClass = "tailscale"
+	}
+
+	cfg.adminAddr = os.Getenv("TIC_ADMIN_ADDR")
+	if cfg.adminAddr == "" {
+		cfg.adminAddr = ":9090"
+	}
+	cfg.controlAddr = os.Getenv("TIC_CONTROL_ADDR")
+	if cfg.controlAddr == "" {
+		cfg.controlAddr = "localhost:9091"
+	}
+
+	return cfg, nil
+}
+
+func durationFromEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
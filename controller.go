@@ -1,52 +1,194 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"tailscale.com/tsnet"
+	"sync/atomic"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 )
 
 type controller struct {
-	tsAuthKey string
-	mu        sync.RWMutex
-	hosts     map[string]*host
+	controllerConfig
+	client kubernetes.Interface
+	// api is the Tailscale API client, if an API key or OAuth client is
+	// configured.
+	api      *tailscale.Client
+	draining atomic.Bool
+	// standby is set while waiting to lead.
+	standby atomic.Bool
+	mu      sync.RWMutex
+	hosts   map[string]*host
+	nodes   map[*node]struct{}
+	// stopping holds the closed nodes until they are stopped, and whether
+	// stopping them is underway.
+	stopping   map[*node]bool
+	sharedNode *node
+	transports map[transportOptions]*http.Transport
+	// rateLimiters are kept across updates by Ingress UID.
+	rateLimiters map[types.UID]*rateLimiter
+	// breakers are kept across updates by Ingress UID and backend.
+	breakers map[breakerKey]*circuitBreaker
+	// retryBudgets are kept across updates by Ingress UID.
+	retryBudgets map[types.UID]*retryBudget
+	routes       routes
+	errors       errorLog
+	// stopped is set by shutdown, after which updates are ignored.
+	stopped bool
+	// recorder emits Events on ingresses, if set.
+	recorder record.EventRecorder
+	// authError is set when the control server rejected the auth key, until
+	// a node comes up.
+	authError string
 }
 
 type host struct {
-	tsServer         *tsnet.Server
-	httpServer       *http.Server
-	pathPrefixes     []*hostPath
-	pathMap          map[string]*hostPath
-	started, deleted bool
-	useTls           bool
+	node         *node
+	pathPrefixes []*hostPath
+	pathMap      map[string]*hostPath
+	// defaultPath serves the requests matching no other path, if set.
+	defaultPath *hostPath
+	// ingresses are those with a rule for the host, whose status lists the
+	// address of its node.
+	ingresses []*v1.Ingress
+	deleted   bool
 }
 
 type hostPath struct {
-	value   string
-	exact   bool
-	backend *url.URL
+	value string
+	exact bool
+	// pattern matches the paths of an ImplementationSpecific path, compiled
+	// from its value anchored at the start.
+	pattern   *regexp.Regexp
+	backend   *url.URL
+	transport http.RoundTripper
+	options   *pathOptions
+	// endpoints are the addresses of the ready pods behind the backend,
+	// which requests are spread over instead of going through the Service.
+	endpoints []string
+	// clusterIP is the address of the Service to use instead of its DNS
+	// name when there are no ready endpoints, if enabled.
+	clusterIP string
+	next      atomic.Uint64
+	// source is the namespace/name of the ingress defining the path.
+	source string
 }
 
-func newController(tsAuthKey string) *controller {
+// pathOptions holds the settings, read from the annotations of the Ingress a
+// path belongs to, that are applied when proxying a request to the path.
+type pathOptions struct {
+	// bodyLimits cap the request body by content type, and maxBodySize
+	// otherwise if not -1.
+	bodyLimits      []contentTypeLimit
+	maxBodySize     int64
+	headerLimits    headerLimits
+	preserveHost    bool
+	rewriteTarget   string
+	securityHeaders bool
+	rateLimiter     *rateLimiter
+	// allowedUsers and allowedTags restrict access to the listed tailnet
+	// users and device tags if either is set.
+	allowedUsers map[string]struct{}
+	allowedTags  map[string]struct{}
+	// forwardedHeaders enables the X-Forwarded-* headers.
+	forwardedHeaders bool
+	// responseHeaders are set on the responses of the backend.
+	responseHeaders http.Header
+	// compressMinSize is the smallest response body that is compressed,
+	// or -1 if compression is disabled.
+	compressMinSize int64
+	// affinity is the session affinity mode, empty for round-robin.
+	affinity string
+}
+
+const (
+	preserveHostAnnotation     = "tailscale.com/preserve-host"
+	rewriteTargetAnnotation    = "tailscale.com/rewrite-target"
+	allowedUsersAnnotation     = "tailscale.com/allowed-users"
+	allowedTagsAnnotation      = "tailscale.com/allowed-tags"
+	forwardedHeadersAnnotation = "tailscale.com/forwarded-headers"
+)
+
+func (c *controller) pathOptionsFromAnnotations(annotations map[string]string) *pathOptions {
+	return &pathOptions{
+		bodyLimits:       parseContentTypeLimits(annotations[maxBodySizeByContentTypeAnnotation]),
+		maxBodySize:      maxBodySize(annotations),
+		headerLimits:     c.headerLimits.withAnnotations(annotations),
+		preserveHost:     boolAnnotation(annotations, preserveHostAnnotation, false),
+		rewriteTarget:    annotations[rewriteTargetAnnotation],
+		securityHeaders:  boolAnnotation(annotations, securityHeadersAnnotation, false),
+		allowedUsers:     setAnnotation(annotations, allowedUsersAnnotation),
+		allowedTags:      setAnnotation(annotations, allowedTagsAnnotation),
+		forwardedHeaders: boolAnnotation(annotations, forwardedHeadersAnnotation, true),
+		responseHeaders:  parseResponseHeaders(annotations[responseHeadersAnnotation]),
+		compressMinSize:  compressMinSize(annotations),
+		affinity:         parseAffinity(annotations),
+	}
+}
+
+func newController(cfg controllerConfig, client kubernetes.Interface) *controller {
 	return &controller{
-		tsAuthKey: tsAuthKey,
-		mu:        sync.RWMutex{},
-		hosts:     make(map[string]*host),
+		controllerConfig: cfg,
+		client:           client,
+		api:              newAPIClient(cfg),
+		mu:               sync.RWMutex{},
+		hosts:            make(map[string]*host),
+		nodes:            make(map[*node]struct{}),
+		stopping:         make(map[*node]bool),
+		transports:       make(map[transportOptions]*http.Transport),
 	}
 }
 
-func (c *controller) getBackendUrl(host, path string) (*url.URL, error) {
+// matchHost returns the name of the host of n that a request Host header
+// refers to. Clients may use the MagicDNS name, e.g. grafana.tailnet.ts.net
+// for the host grafana or a node named grafana, so the header is tried as is
+// and then with its last labels stripped one by one. Without a match, the
+// header without its port is returned.
+func (c *controller) matchHost(n *node, requestHost string) string {
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	requestHost = strings.TrimSuffix(requestHost, ".")
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name := requestHost; name != ""; {
+		if h, ok := c.hosts[name]; ok && h.node == n {
+			return name
+		}
+		// The node of a single host may be named differently.
+		if name == n.hostname() && !c.sharedNodeEnabled {
+			for hn, h := range c.hosts {
+				if h.node == n {
+					return hn
+				}
+			}
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return requestHost
+}
+
+func (c *controller) getHostPath(host, path string) (*hostPath, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	h, ok := c.hosts[host]
@@ -54,92 +196,247 @@ func (c *controller) getBackendUrl(host, path string) (*url.URL, error) {
 		return nil, fmt.Errorf("host not found")
 	}
 	if _, ok = h.pathMap[path]; ok {
-		return h.pathMap[path].backend, nil
+		return h.pathMap[path], nil
 	}
 	for _, p := range h.pathPrefixes {
-		if strings.HasPrefix(path, p.value) {
-			return p.backend, nil
+		if p.matches(path) {
+			return p, nil
 		}
 	}
+	if h.defaultPath != nil {
+		return h.defaultPath, nil
+	}
 	return nil, fmt.Errorf("path not found")
 }
 
 func (c *controller) update(payload *update) {
+	// Nodes are started without the lock held, as minting an auth key and
+	// bringing a node up take a while and requests to the other hosts need
+	// the lock to be routed meanwhile.
+	start, stop := c.reconcile(payload)
+	// Requests in flight on removed or recreated nodes get the same time to
+	// complete as on shutdown.
+	for _, n := range stop {
+		go func(n *node) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+			defer cancel()
+			c.stopNode(ctx, n)
+		}(n)
+	}
+	for _, n := range start {
+		if err := c.startNode(n); err != nil {
+			c.recordError(errorKindNode, n.hostname(), "%v", err)
+		}
+	}
+}
+
+// reconcile rebuilds the routes from an update and returns the nodes that
+// need to be started and those that were closed and need to be stopped.
+func (c *controller) reconcile(payload *update) (start, stop []*node) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	for h := range c.hosts {
-		c.hosts[h].deleted = true
+	if c.stopped {
+		log.Println("ignoring update during shutdown")
+		return nil, nil
 	}
-	for _, ingress := range payload.ingresses {
-		tlsHosts := make(map[string]struct{})
+	// Routes are rebuilt from scratch on every update, so removed paths
+	// disappear and the precedence order is recomputed.
+	for _, h := range c.hosts {
+		h.deleted = true
+		h.pathMap = make(map[string]*hostPath)
+		h.pathPrefixes = nil
+		h.defaultPath = nil
+		h.ingresses = nil
+	}
+	services, endpointSlices := indexServices(payload.services, payload.endpointSlices)
+	rateLimiters := make(map[types.UID]*rateLimiter)
+	breakers := make(map[breakerKey]*circuitBreaker)
+	retryBudgets := make(map[types.UID]*retryBudget)
+	// Several ingresses may define the same host, in which case their paths
+	// are merged. The oldest one wins conflicts and sets the node settings,
+	// so that the result doesn't depend on the listing order.
+	ingresses := c.filterIngresses(payload.ingresses, payload.ingressClasses)
+	sort.SliceStable(ingresses, func(i, j int) bool {
+		a, b := ingresses[i], ingresses[j]
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	})
+	// A host uses TLS if any of its ingresses lists it under tls.
+	tlsHosts := make(map[string]struct{})
+	for _, ingress := range ingresses {
 		for _, t := range ingress.Spec.TLS {
 			for _, h := range t.Hosts {
 				tlsHosts[h] = struct{}{}
 			}
 		}
+	}
+	for _, ingress := range ingresses {
+		scheme := backendScheme(ingress.Annotations)
+		transport := c.withRetries(c.transport(c.transportOptionsFromAnnotations(ingress.Annotations)), ingress, retryBudgets)
+		options := c.pathOptionsFromAnnotations(ingress.Annotations)
+		options.rateLimiter = c.rateLimiter(ingress, rateLimiters)
 		for _, rule := range ingress.Spec.Rules {
 			if rule.Host == "" {
-				log.Println("ignoring ingress rule without host")
+				log.Printf("ignoring rule without host of ingress %s/%s", ingress.Namespace, ingress.Name)
+				c.event(ingress, corev1.EventTypeWarning, "RuleIgnored", "Ignoring rule without host")
 				continue
 			}
 			if strings.Contains(rule.Host, "*") {
-				log.Println("ignoring ingress rule with wildcard host")
+				log.Printf("ignoring rule with wildcard host of ingress %s/%s", ingress.Namespace, ingress.Name)
+				c.event(ingress, corev1.EventTypeWarning, "RuleIgnored", "Ignoring rule with wildcard host %s", rule.Host)
 				continue
 			}
-			if rule.HTTP == nil {
-				log.Println("ignoring ingress rule without http")
+			if rule.HTTP == nil && ingress.Spec.DefaultBackend == nil {
+				log.Printf("ignoring rule without http of ingress %s/%s", ingress.Namespace, ingress.Name)
+				c.event(ingress, corev1.EventTypeWarning, "RuleIgnored", "Ignoring rule of host %s without http", rule.Host)
 				continue
 			}
-			_, ok := c.hosts[rule.Host]
+			_, useTls := tlsHosts[rule.Host]
+			nodeName := nodeHostname(ingress, rule.Host)
+			nodeTimeouts := c.timeouts.withAnnotations(ingress.Annotations)
+			tags := parseTags(ingress.Annotations[tagsAnnotation])
+			extraPorts := parsePorts(ingress.Annotations[extraPortsAnnotation])
+			// Tailnet hostnames are case-insensitive, and two nodes can't
+			// share one, nor its state directory. The host claimed first
+			// keeps it.
+			if other := c.hostWithNode(nodeName, rule.Host); other != "" {
+				c.recordError(errorKindConfig, rule.Host, "ingress %s/%s uses node hostname %s, which is already used by host %s", ingress.Namespace, ingress.Name, nodeName, other)
+				c.event(ingress, corev1.EventTypeWarning, "HostnameConflict", "Node hostname %s of host %s is already used by host %s", nodeName, rule.Host, other)
+				continue
+			}
+			h, ok := c.hosts[rule.Host]
+			// Route changes are applied to the running node; it is only
+			// recreated if a setting of the node itself changed. The first
+			// ingress of the host in this update decides.
+			if ok && h.deleted && !c.sharedNodeEnabled {
+				if change := h.node.settingsChange(nodeName, useTls, nodeTimeouts, extraPorts); change != "" {
+					log.Printf("recreating node of host %s as its %s changed", rule.Host, change)
+					c.closeNode(h.node)
+					delete(c.hosts, rule.Host)
+					ok = false
+				} else {
+					c.setTags(h.node, tags)
+				}
+			}
 			if !ok {
-				confDir, err := os.UserConfigDir()
+				n, err := c.nodeForHost(nodeName, useTls, nodeTimeouts, tags, extraPorts)
 				if err != nil {
-					log.Println("failed to get user config dir: ", err)
-					continue
-				}
-				dir := filepath.Join(confDir, "ts", rule.Host)
-				if err = os.MkdirAll(dir, 0755); err != nil {
-					log.Println("failed to create config dir: ", err)
+					c.recordError(errorKindNode, rule.Host, "%v", err)
+					c.event(ingress, corev1.EventTypeWarning, "NodeFailed", "Failed to create node for host %s: %v", rule.Host, err)
 					continue
 				}
-				_, useTls := tlsHosts[rule.Host]
 				c.hosts[rule.Host] = &host{
-					tsServer: &tsnet.Server{
-						Dir: dir,
-						//Store:     nil, TODO: store in k8s
-						Hostname:  rule.Host,
-						Ephemeral: true,
-						AuthKey:   c.tsAuthKey,
+					node:    n,
+					pathMap: make(map[string]*hostPath),
+				}
+			}
+			h = c.hosts[rule.Host]
+			h.deleted = false
+			h.ingresses = append(h.ingresses, ingress)
+
+			newPath := func(value string, exact bool, backend v1.IngressBackend) *hostPath {
+				if backend.Service == nil {
+					log.Printf("ignoring path %s of host %s without a service backend", value, rule.Host)
+					c.event(ingress, corev1.EventTypeWarning, "PathIgnored", "Ignoring path %s of host %s without a service backend", value, rule.Host)
+					return nil
+				}
+				// The path is still routed so that it works as soon as the
+				// Service is created.
+				svcKey := serviceKey{ingress.Namespace, backend.Service.Name}
+				svc, svcFound := services[svcKey]
+				if !svcFound {
+					c.recordError(errorKindService, rule.Host, "ingress %s/%s references missing service %s for path %s", ingress.Namespace, ingress.Name, svcKey.name, value)
+					c.event(ingress, corev1.EventTypeWarning, "ServiceNotFound", "Service %s of path %s of host %s not found", svcKey.name, value, rule.Host)
+				}
+				// Services are reached by their namespaced name, so that
+				// ingresses in every namespace work, and ExternalName
+				// Services by their external name, which lets a path route to
+				// a Service in another namespace.
+				backendHost := backend.Service.Name + "." + ingress.Namespace + ".svc"
+				port := backend.Service.Port.Number
+				externalName := svcFound && svc.Spec.Type == corev1.ServiceTypeExternalName
+				if svcFound {
+					port = servicePort(svc, backend.Service.Port)
+				}
+				if externalName {
+					backendHost = svc.Spec.ExternalName
+				}
+				p := &hostPath{
+					value: value,
+					exact: exact,
+					backend: &url.URL{
+						Scheme: scheme,
+						Host:   net.JoinHostPort(backendHost, strconv.Itoa(int(port))),
 					},
-					useTls: useTls,
+					options: options,
+					source:  ingress.Namespace + "/" + ingress.Name,
+				}
+				p.transport = c.withBreaker(transport, ingress, p.backend.Host, breakers)
+				// Pod IPs can't be used to verify the certificate of an
+				// HTTPS backend, which is always reached through its
+				// Service.
+				if svcFound && !externalName && scheme == "http" {
+					p.endpoints = readyEndpoints(svc, backend.Service.Port, endpointSlices[svcKey])
+					if c.resolveClusterIP && svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != corev1.ClusterIPNone {
+						p.clusterIP = net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(port)))
+					}
 				}
+				return p
 			}
-			c.hosts[rule.Host].deleted = false
+
+			// The default backend serves the requests to the hosts of the
+			// ingress that match none of the paths.
 			if ingress.Spec.DefaultBackend != nil {
-				log.Println("ignoring ingress default backend")
+				if h.defaultPath != nil {
+					log.Printf("ignoring default backend of ingress %s/%s, host %s already has one", ingress.Namespace, ingress.Name, rule.Host)
+					c.event(ingress, corev1.EventTypeWarning, "DefaultBackendIgnored", "Ignoring default backend, host %s already has one", rule.Host)
+				} else {
+					h.defaultPath = newPath("", false, *ingress.Spec.DefaultBackend)
+				}
+			}
+			if rule.HTTP == nil {
 				continue
 			}
 
 			for _, path := range rule.HTTP.Paths {
-				if _, ok = c.hosts[rule.Host].pathMap[path.Path]; !ok {
-					c.hosts[rule.Host].pathMap = make(map[string]*hostPath, 0)
-				}
-				if path.PathType == nil {
-					log.Println("ignoring ingress path without path type")
-					continue
+				pathType := c.defaultPathType
+				if path.PathType != nil {
+					pathType = *path.PathType
+				} else {
+					log.Printf("using default path type %s for path %s of host %s", pathType, path.Path, rule.Host)
 				}
 
-				p := &hostPath{
-					value: path.Path,
-					exact: *path.PathType == v1.PathTypeExact,
-					backend: &url.URL{
-						Scheme: "http",
-						Host:   fmt.Sprintf("%s:%d", path.Backend.Service.Name, path.Backend.Service.Port.Number),
-					},
+				var pattern *regexp.Regexp
+				if pathType == v1.PathTypeImplementationSpecific {
+					var err error
+					if pattern, err = regexp.Compile("^(?:" + path.Path + ")"); err != nil {
+						c.recordError(errorKindConfig, rule.Host, "ignoring path of ingress %s/%s with invalid regular expression %s: %v", ingress.Namespace, ingress.Name, path.Path, err)
+						c.event(ingress, corev1.EventTypeWarning, "PathIgnored", "Ignoring path %s of host %s with invalid regular expression: %v", path.Path, rule.Host, err)
+						continue
+					}
+				}
+				p := newPath(path.Path, pathType == v1.PathTypeExact, path.Backend)
+				if p == nil {
+					continue
 				}
+				p.pattern = pattern
 
-				c.hosts[rule.Host].pathMap[p.value] = p
-				if !p.exact {
+				// Exact paths take precedence over prefixes and regular
+				// expressions, which are kept sorted from longest to
+				// shortest so that a catch-all / is tried last.
+				if p.exact {
+					if existing, ok := h.pathMap[p.value]; ok {
+						c.pathConflict(ingress, rule.Host, existing, p)
+						continue
+					}
+					h.pathMap[p.value] = p
+				} else {
+					if existing := findPath(h.pathPrefixes, p); existing != nil {
+						c.pathConflict(ingress, rule.Host, existing, p)
+						continue
+					}
 					appendSorted := func(l []*hostPath, e *hostPath) []*hostPath {
 						i := sort.Search(len(l), func(i int) bool {
 							return len(l[i].value) < len(e.value)
@@ -152,87 +449,427 @@ func (c *controller) update(payload *update) {
 						l[i] = e
 						return l
 					}
-					c.hosts[rule.Host].pathPrefixes = appendSorted(c.hosts[rule.Host].pathPrefixes, p)
+					h.pathPrefixes = appendSorted(h.pathPrefixes, p)
 				}
 			}
 		}
 	}
-	for n, h := range c.hosts {
+	c.rateLimiters = rateLimiters
+	c.setBreakers(breakers)
+	c.setRetryBudgets(retryBudgets)
+	inUse := make(map[*node]bool)
+	for name, h := range c.hosts {
 		if h.deleted {
-			log.Println("deleting host ", n)
-			if err := h.httpServer.Close(); err != nil {
-				log.Printf("failed to close http server: %v", err)
-			}
-			if err := h.tsServer.Close(); err != nil {
-				log.Printf("failed to close ts server: %v", err)
-			}
-			delete(c.hosts, n)
+			log.Println("deleting host ", name)
+			delete(c.hosts, name)
 			continue
 		}
-		if h.started {
-			log.Printf("host %s already started", n)
+		inUse[h.node] = true
+	}
+	nodes := make([]*node, 0, len(c.nodes))
+	for n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	for _, n := range nodes {
+		if !inUse[n] {
+			log.Println("closing node ", n.hostname())
+			c.closeNode(n)
 			continue
 		}
-
-		var ln net.Listener
-		var err error
-		if h.useTls {
-			ln, err = h.tsServer.Listen("tcp", ":443")
-		} else {
-			ln, err = h.tsServer.Listen("tcp", ":80")
+		if c.dryRun {
+			continue
 		}
-		if err != nil {
-			log.Println("failed to listen: ", err)
+		if n.failed {
+			restarted, err := c.restartNode(n)
+			if err != nil {
+				c.recordError(errorKindNode, n.hostname(), "%v", err)
+				continue
+			}
+			n = restarted
+		}
+		if n.started || n.starting {
+			log.Printf("node %s already started", n.hostname())
 			continue
 		}
-		lc, err := h.tsServer.LocalClient()
+		start = append(start, n)
+	}
+
+	routes := c.snapshotRoutes()
+	logRoutesDiff(c.routes, routes)
+	c.routes = routes
+	c.updateHostMetrics()
+	c.syncStatus()
+	return start, c.closedNodes()
+}
+
+// shutdown stops all hosts, letting in-flight requests complete until ctx is
+// done. Any update after this is ignored so that a late informer event can't
+// bring hosts back up during termination.
+func (c *controller) shutdown(ctx context.Context) {
+	c.mu.Lock()
+	c.stopped = true
+	for n := range c.nodes {
+		c.closeNode(n)
+	}
+	stop := c.closedNodes()
+	// Nodes still starting are stopped once up, and those closed by an
+	// earlier update may still be stopping.
+	var done []chan struct{}
+	for n := range c.stopping {
+		done = append(done, n.done)
+	}
+	c.mu.Unlock()
+
+	// The lock isn't held while draining, since handlers need it to look up
+	// their backend.
+	for _, n := range stop {
+		log.Println("shutting down node ", n.hostname())
+		go c.stopNode(ctx, n)
+	}
+wait:
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-ctx.Done():
+			log.Println("gave up waiting for nodes to stop: ", ctx.Err())
+			break wait
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := range c.hosts {
+		delete(c.hosts, n)
+	}
+}
+
+// nodeForHost returns the node that serves a new host: the shared node when
+// enabled, or else a node of its own named after the host. c.mu must be held
+// for writing.
+func (c *controller) nodeForHost(name string, useTls bool, t timeouts, tags []string, extraPorts []int) (*node, error) {
+	if !c.sharedNodeEnabled {
+		return c.newNode(name, useTls, t, tags, extraPorts)
+	}
+	if c.sharedNode == nil {
+		n, err := c.newNode(c.sharedNodeHostname, useTls, t, tags, extraPorts)
 		if err != nil {
-			log.Println("failed to get local client: ", err)
-			continue
+			return nil, err
 		}
-		if h.useTls {
-			ln = tls.NewListener(ln, &tls.Config{
-				GetCertificate: lc.GetCertificate,
-			})
+		c.sharedNode = n
+	} else if useTls != c.sharedNode.useTls {
+		log.Printf("host %s uses the TLS setting of shared node %s", name, c.sharedNode.hostname())
+	}
+	return c.sharedNode, nil
+}
+
+// hostWithNode returns the host other than host that is already routed in the
+// current update to a node named hostname, if any. A shared node serves every
+// host. c.mu must be held.
+func (c *controller) hostWithNode(hostname, host string) string {
+	if c.sharedNodeEnabled {
+		return ""
+	}
+	for name, h := range c.hosts {
+		if name != host && !h.deleted && strings.EqualFold(h.node.hostname(), hostname) {
+			return name
 		}
+	}
+	return ""
+}
+
+// findPath returns the path of l with the same value and type as p, if any.
+func findPath(l []*hostPath, p *hostPath) *hostPath {
+	for _, e := range l {
+		if e.key() == p.key() {
+			return e
+		}
+	}
+	return nil
+}
 
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Hack since the host will include a tailnet name when using TLS.
-			rh := r.Host
-			if h.useTls && strings.HasPrefix(rh, h.tsServer.Hostname) {
-				rh = h.tsServer.Hostname
+// pathConflict reports a path of host defined again by p, of ingress, after
+// existing, which is kept. Paths routing to the same backend aren't a
+// conflict.
+func (c *controller) pathConflict(ingress *v1.Ingress, host string, existing, p *hostPath) {
+	if existing.backend.String() == p.backend.String() {
+		log.Printf("ignoring duplicate path %s of host %s in ingress %s", p.key(), host, p.source)
+		return
+	}
+	c.recordError(errorKindConfig, host, "path %s of ingress %s conflicts with ingress %s, which routes it to %s instead of %s", p.key(), p.source, existing.source, existing.backend, p.backend)
+	c.event(ingress, corev1.EventTypeWarning, "PathConflict", "Path %s of host %s is routed to %s by ingress %s", p.key(), host, existing.backend, existing.source)
+}
+
+// whoIsClient looks up the tailnet identity behind a remote address, as a
+// node's LocalClient does.
+type whoIsClient interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// newHandler returns the handler that proxies the requests a node receives to
+// the backend of the matching host and path.
+func (c *controller) newHandler(n *node, lc whoIsClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rh := c.matchHost(n, r.Host)
+		if c.draining.Load() {
+			http.Error(w, "host is draining", http.StatusServiceUnavailable)
+			observeRequest(c.hostLabel(rh), "", http.StatusServiceUnavailable)
+			return
+		}
+		p, err := c.getHostPath(rh, r.URL.Path)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("upstream server %s not found", rh), http.StatusNotFound)
+			label := c.hostLabel(rh)
+			observeProxyError(label, "not_found")
+			observeRequest(label, "", http.StatusNotFound)
+			return
+		}
+		backend := p.backend.Host
+		// Security headers are set up front so that error responses get
+		// them too; for proxied responses they are moved over to the
+		// backend response in ModifyResponse.
+		var secHeaders http.Header
+		if p.options.securityHeaders {
+			secHeaders = securityHeaders(n.useTls)
+			setHeaders(w.Header(), secHeaders, false)
+		}
+		if err := checkBackendAddr(p.backend); err != nil {
+			log.Printf("not proxying request to %s%s: %v", rh, r.URL.Path, err)
+			http.Error(w, "invalid backend", http.StatusBadGateway)
+			observeProxyError(rh, "invalid_backend")
+			observeRequest(rh, backend, http.StatusBadGateway)
+			return
+		}
+		if !p.options.headerLimits.check(w, r) {
+			observeRequest(rh, backend, http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		limit, ok := bodyLimit(p.options.bodyLimits, r.Header.Get("Content-Type"))
+		if !ok && p.options.maxBodySize >= 0 {
+			limit, ok = p.options.maxBodySize, true
+		}
+		if ok {
+			if !limitBody(w, r, limit) {
+				observeRequest(rh, backend, http.StatusRequestEntityTooLarge)
+				return
 			}
-			backendURL, err := c.getBackendUrl(rh, r.URL.Path)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("upstream server %s not found", rh), http.StatusNotFound)
+		}
+		// Bound the lookup so a slow local client doesn't stall the request;
+		// without an identity it is either rejected or proxied without the
+		// webauth headers.
+		ctx, cancel := context.WithTimeout(r.Context(), c.whoIsTimeout)
+		who, err := lc.WhoIs(ctx, r.RemoteAddr)
+		cancel()
+		if err != nil {
+			log.Println("failed to get the owner of the request: ", err)
+			who = nil
+			if c.requireIdentity {
+				http.Error(w, "unable to identify client", http.StatusForbidden)
+				observeRequest(rh, backend, http.StatusForbidden)
 				return
 			}
-			// TODO: optional request logging
-			director := func(req *http.Request) {
-				req.URL = backendURL
-				who, err := lc.WhoIs(req.Context(), req.RemoteAddr)
-				if err != nil {
-					log.Println("failed to get the owner of the request")
-					return
-				}
-				if who.UserProfile == nil {
-					log.Println("user profile is nil")
-					return
+		}
+		setAccessUser(r, who)
+		if !p.options.allowed(who) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			observeRequest(rh, backend, http.StatusForbidden)
+			return
+		}
+		if l := p.options.rateLimiter; l != nil && !l.allow(rh, clientKey(who, r.RemoteAddr)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			observeRequest(rh, backend, http.StatusTooManyRequests)
+			return
+		}
+		backendHost, pinCookie := p.pickBackend(r, who, n.useTls)
+		director := func(req *http.Request) {
+			// Backends trust the webauth headers, so those sent by the
+			// client never reach them, whether or not the client has an
+			// identity to replace them with.
+			req.Header.Del("X-Webauth-User")
+			req.Header.Del("X-Webauth-Name")
+			// Only point the request at the backend; unless rewritten, the
+			// path, including its original encoding in RawPath, and the
+			// query are kept exactly as the client sent them.
+			req.URL.Scheme = p.backend.Scheme
+			req.URL.Host = backendHost
+			if p.options.rewriteTarget != "" {
+				p.rewritePath(req.URL)
+			}
+			// The proxy appends the client address to X-Forwarded-For
+			// unless the header is nil.
+			if p.options.forwardedHeaders {
+				proto := "http"
+				if n.useTls {
+					proto = "https"
 				}
-				req.Header.Set("X-Webauth-User", who.UserProfile.LoginName)
-				req.Header.Set("X-Webauth-Name", who.UserProfile.DisplayName)
+				req.Header.Set("X-Forwarded-Proto", proto)
+				req.Header.Set("X-Forwarded-Host", req.Host)
+			} else {
+				req.Header["X-Forwarded-For"] = nil
 			}
-			proxy := &httputil.ReverseProxy{Director: director}
-			proxy.ServeHTTP(w, r)
-		})
+			// Backends see their own service address as the Host unless
+			// they expect the one the client used.
+			if !p.options.preserveHost {
+				req.Host = p.backend.Host
+			}
+			if who == nil {
+				return
+			}
+			if who.UserProfile == nil {
+				log.Println("user profile is nil")
+				return
+			}
+			req.Header.Set("X-Webauth-User", who.UserProfile.LoginName)
+			req.Header.Set("X-Webauth-Name", who.UserProfile.DisplayName)
+		}
+		proxy := &httputil.ReverseProxy{
+			Director:  director,
+			Transport: p.transport,
+			ModifyResponse: func(resp *http.Response) error {
+				// Headers the backend sets itself take precedence.
+				for k := range secHeaders {
+					w.Header().Del(k)
+				}
+				setHeaders(resp.Header, secHeaders, true)
+				setHeaders(resp.Header, p.options.responseHeaders, false)
+				if pinCookie != nil {
+					resp.Header.Add("Set-Cookie", pinCookie.String())
+				}
+				if p.options.compressMinSize >= 0 {
+					compressResponse(resp, p.options.compressMinSize)
+				}
+				observeRequest(rh, backend, resp.StatusCode)
+				return nil
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				setHeaders(w.Header(), secHeaders, false)
+				code := writeProxyError(w, err)
+				switch code {
+				case http.StatusBadGateway:
+					observeProxyError(rh, "backend")
+				case http.StatusServiceUnavailable:
+					observeProxyError(rh, "circuit_open")
+				}
+				observeRequest(rh, backend, code)
+			},
+		}
+		// The proxy handles protocol switches itself, including the
+		// Connection and Upgrade headers, by hijacking the connection.
+		if isUpgrade(r) {
+			w = upgradeResponseWriter{w}
+		}
+		r = withRetryHost(r, p.retryHost)
+		proxy.ServeHTTP(w, forwardInformational(w, r))
+	})
+}
 
-		srv := http.Server{Handler: handler}
-		c.hosts[n].httpServer = &srv
-		go func() {
-			if err := srv.Serve(ln); err != nil {
-				log.Println("failed to serve: ", err)
+// allowed reports whether the tailnet identity who may access the path. Any
+// client may if no users or tags are listed, none without an identity
+// otherwise.
+func (o *pathOptions) allowed(who *apitype.WhoIsResponse) bool {
+	if o.allowedUsers == nil && o.allowedTags == nil {
+		return true
+	}
+	if who == nil {
+		return false
+	}
+	if who.UserProfile != nil {
+		if _, ok := o.allowedUsers[who.UserProfile.LoginName]; ok {
+			return true
+		}
+	}
+	if who.Node != nil {
+		for _, t := range who.Node.Tags {
+			if _, ok := o.allowedTags[t]; ok {
+				return true
 			}
-		}()
-		c.hosts[n].started = true
+		}
+	}
+	return false
+}
+
+// matches reports whether path matches the prefix or regular expression of p.
+// As per the Ingress spec, prefixes match whole path segments: /foo and /foo/
+// both match /foo and /foo/bar, but not /foobar.
+func (p *hostPath) matches(path string) bool {
+	if p.pattern != nil {
+		return p.pattern.MatchString(path)
+	}
+	prefix := strings.TrimSuffix(p.value, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// rewritePath replaces the part of the path matched by p with the rewrite
+// target, e.g. /api/users becomes /users for the prefix /api and the target /.
+func (p *hostPath) rewritePath(u *url.URL) {
+	rewrite := func(path string) string {
+		if p.exact {
+			return p.options.rewriteTarget
+		}
+		if p.pattern != nil {
+			return p.rewriteMatch(path)
+		}
+		rest := strings.TrimPrefix(path, strings.TrimSuffix(p.value, "/"))
+		if rest == "" {
+			return p.options.rewriteTarget
+		}
+		if !strings.HasPrefix(rest, "/") {
+			rest = "/" + rest
+		}
+		return strings.TrimSuffix(p.options.rewriteTarget, "/") + rest
+	}
+	// Keep the original encoding if the matched prefix is encoded the same
+	// way in RawPath.
+	if u.RawPath != "" && p.pattern == nil && strings.HasPrefix(u.RawPath, strings.TrimSuffix(p.value, "/")) {
+		u.RawPath = rewrite(u.RawPath)
+	} else {
+		u.RawPath = ""
+	}
+	u.Path = rewrite(u.Path)
+	if u.Path == "" {
+		u.Path = "/"
+	}
+}
+
+// rewriteMatch replaces the part of path matched by the regular expression of
+// p with the rewrite target, in which $1 and the like refer to its groups.
+func (p *hostPath) rewriteMatch(path string) string {
+	m := p.pattern.FindStringSubmatchIndex(path)
+	if m == nil {
+		return path
+	}
+	return string(p.pattern.ExpandString(nil, p.options.rewriteTarget, path, m)) + path[m[1]:]
+}
+
+// checkBackendAddr reports an error if a backend has no host or port to dial,
+// e.g. because its service port was given by a name that wasn't resolved.
+func checkBackendAddr(u *url.URL) error {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return fmt.Errorf("invalid backend address %q: %w", u.Host, err)
+	}
+	if host == "" {
+		return fmt.Errorf("backend address %q has no host", u.Host)
+	}
+	if port == "" || port == "0" {
+		return fmt.Errorf("backend address %q has no port", u.Host)
+	}
+	return nil
+}
+
+// writeProxyError responds to a request that failed to be proxied and returns
+// the status code it used.
+func writeProxyError(w http.ResponseWriter, err error) int {
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+		return http.StatusServiceUnavailable
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, fmt.Sprintf("request body exceeds the limit of %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+		return http.StatusRequestEntityTooLarge
 	}
+	log.Printf("proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+	return http.StatusBadGateway
 }
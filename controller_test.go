@@ -0,0 +1,1120 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+	"testing"
+	"time"
+)
+
+// newTestController returns a controller in dry run mode, so that it creates
+// nodes without starting them, keeping their state in a temporary directory.
+func newTestController(t *testing.T, cfg controllerConfig) *controller {
+	t.Helper()
+	cfg.dryRun = true
+	cfg.stateDir = t.TempDir()
+	if cfg.ingressClass == "" {
+		cfg.ingressClass = "tailscale"
+	}
+	if cfg.defaultPathType == "" {
+		cfg.defaultPathType = v1.PathTypePrefix
+	}
+	if cfg.transportOptions == (transportOptions{}) {
+		cfg.transportOptions = defaultTransportOptions
+	}
+	return newController(cfg, nil)
+}
+
+// testIngress returns an ingress of our class routing the given paths of host.
+func testIngress(name, host string, paths ...v1.HTTPIngressPath) *v1.Ingress {
+	class := "tailscale"
+	return &v1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+		Spec: v1.IngressSpec{
+			IngressClassName: &class,
+			Rules: []v1.IngressRule{{
+				Host: host,
+				IngressRuleValue: v1.IngressRuleValue{
+					HTTP: &v1.HTTPIngressRuleValue{Paths: paths},
+				},
+			}},
+		},
+	}
+}
+
+// ingressPath returns a path routed to port 80 of service, without a path type
+// if pathType is empty.
+func ingressPath(path string, pathType v1.PathType, service string) v1.HTTPIngressPath {
+	p := v1.HTTPIngressPath{
+		Path: path,
+		Backend: v1.IngressBackend{Service: &v1.IngressServiceBackend{
+			Name: service,
+			Port: v1.ServiceBackendPort{Number: 80},
+		}},
+	}
+	if pathType != "" {
+		p.PathType = &pathType
+	}
+	return p
+}
+
+// routedTo returns the name of the service the request path of host is routed
+// to, or "" if it isn't routed.
+func routedTo(c *controller, host, path string) string {
+	p, err := c.getHostPath(host, path)
+	if err != nil {
+		return ""
+	}
+	name, _, _ := strings.Cut(p.backend.Hostname(), ".")
+	return name
+}
+
+func TestDefaultPathType(t *testing.T) {
+	for _, tt := range []struct {
+		defaultType v1.PathType
+		want        map[string]string
+	}{
+		{v1.PathTypePrefix, map[string]string{"/api": "api", "/api/users": "api", "/apiv2": "", "/exact": "exact"}},
+		{v1.PathTypeExact, map[string]string{"/api": "api", "/api/users": "", "/apiv2": "", "/exact": "exact"}},
+		{v1.PathTypeImplementationSpecific, map[string]string{"/api": "api", "/api/users": "api", "/apiv2": "api", "/exact": "exact"}},
+	} {
+		t.Run(string(tt.defaultType), func(t *testing.T) {
+			c := newTestController(t, controllerConfig{defaultPathType: tt.defaultType})
+			c.update(&update{ingresses: []*v1.Ingress{testIngress("app", "app.example.com",
+				ingressPath("/api", "", "api"),
+				ingressPath("/exact", v1.PathTypeExact, "exact"),
+			)}})
+			for path, want := range tt.want {
+				if got := routedTo(c, "app.example.com", path); got != want {
+					t.Errorf("%s routed to %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+// fakeWhoIs answers WhoIs lookups with who, or err, after delay.
+type fakeWhoIs struct {
+	who   *apitype.WhoIsResponse
+	err   error
+	delay time.Duration
+}
+
+func (f fakeWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return f.who, f.err
+}
+
+// testBackend serves h and returns a Service named name and an EndpointSlice
+// routing port 80 of the Service to it.
+func testBackend(t *testing.T, name string, h http.Handler) (*corev1.Service, *discoveryv1.EndpointSlice) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return testService(name), testEndpoints(name, srv.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+func testService(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeClusterIP,
+			ClusterIP: "10.0.0.1",
+			Ports:     []corev1.ServicePort{{Port: 80}},
+		},
+	}
+}
+
+// testEndpoints returns an EndpointSlice with a ready endpoint on port of
+// localhost for the Service name.
+func testEndpoints(name string, port int) *discoveryv1.EndpointSlice {
+	p := int32(port)
+	empty := ""
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-1",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: name},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"127.0.0.1"}}},
+		Ports:       []discoveryv1.EndpointPort{{Name: &empty, Port: &p}},
+	}
+}
+
+// serveHost serves the requests to host like its node does, identifying
+// clients with who.
+func serveHost(t *testing.T, c *controller, host string, who whoIsClient) *httptest.Server {
+	t.Helper()
+	c.mu.RLock()
+	h, ok := c.hosts[host]
+	c.mu.RUnlock()
+	if !ok {
+		t.Fatalf("host %s not found", host)
+	}
+	handler := c.newHandler(h.node, who)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host = host
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// serveBackend routes ing, whose paths go to the Service web, to h.
+func serveBackend(t *testing.T, c *controller, ing *v1.Ingress, h http.Handler) {
+	t.Helper()
+	svc, eps := testBackend(t, "web", h)
+	c.update(&update{
+		ingresses:      []*v1.Ingress{ing},
+		services:       []*corev1.Service{svc},
+		endpointSlices: []*discoveryv1.EndpointSlice{eps},
+	})
+}
+
+// webauthBackend routes ing to a backend that echoes the webauth headers it
+// receives.
+func webauthBackend(t *testing.T, c *controller, ing *v1.Ingress) {
+	t.Helper()
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("X-Webauth-User"), r.Header.Get("X-Webauth-Name"))
+	}))
+}
+
+// webauthIngress routes app.example.com to the backend of webauthBackend.
+func webauthIngress() *v1.Ingress {
+	return testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+}
+
+// getWithHeaders sends a GET request with the given headers and returns the
+// response status and body.
+func getWithHeaders(t *testing.T, url string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestSlowWhoIs(t *testing.T) {
+	forged := http.Header{"X-Webauth-User": {"admin@example.com"}, "X-Webauth-Name": {"Admin"}}
+	for _, tt := range []struct {
+		requireIdentity bool
+		wantCode        int
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusForbidden},
+	} {
+		c := newTestController(t, controllerConfig{whoIsTimeout: 50 * time.Millisecond, requireIdentity: tt.requireIdentity})
+		webauthBackend(t, c, webauthIngress())
+		srv := serveHost(t, c, "app.example.com", fakeWhoIs{who: &apitype.WhoIsResponse{}, delay: time.Minute})
+
+		start := time.Now()
+		code, body := getWithHeaders(t, srv.URL, forged)
+		if d := time.Since(start); d > 10*time.Second {
+			t.Errorf("require identity %t: request took %v despite the WhoIs timeout", tt.requireIdentity, d)
+		}
+		if code != tt.wantCode {
+			t.Errorf("require identity %t: got status %d, want %d", tt.requireIdentity, code, tt.wantCode)
+		}
+		if code == http.StatusOK && body != "|" {
+			t.Errorf("require identity %t: backend got webauth headers %q, want none", tt.requireIdentity, body)
+		}
+	}
+}
+
+func TestForgedWebauthHeaders(t *testing.T) {
+	forged := http.Header{"X-Webauth-User": {"admin@example.com"}, "X-Webauth-Name": {"Admin"}}
+	alice := &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+	}
+	tagged := &apitype.WhoIsResponse{Node: &tailcfg.Node{Tags: []string{"tag:ci"}}}
+	for _, tt := range []struct {
+		name string
+		who  fakeWhoIs
+		want string
+	}{
+		{"user", fakeWhoIs{who: alice}, "alice@example.com|Alice"},
+		{"tagged node", fakeWhoIs{who: tagged}, "|"},
+		{"whois error", fakeWhoIs{err: errors.New("no peer found")}, "|"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			webauthBackend(t, c, webauthIngress())
+			srv := serveHost(t, c, "app.example.com", tt.who)
+			code, body := getWithHeaders(t, srv.URL, forged.Clone())
+			if code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", code, http.StatusOK)
+			}
+			if body != tt.want {
+				t.Errorf("backend got webauth headers %q, want %q", body, tt.want)
+			}
+		})
+	}
+
+	// Forged headers don't grant access to paths restricted to a user.
+	c := newTestController(t, controllerConfig{})
+	ing := webauthIngress()
+	ing.Annotations = map[string]string{allowedUsersAnnotation: "admin@example.com"}
+	webauthBackend(t, c, ing)
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{who: alice})
+	if code, _ := getWithHeaders(t, srv.URL, forged.Clone()); code != http.StatusForbidden {
+		t.Errorf("got status %d for a forged allowed user, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestDuplicateNodeHostname(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	recorder := record.NewFakeRecorder(10)
+	c.recorder = recorder
+	first := testIngress("first", "a.example.com", ingressPath("/", v1.PathTypePrefix, "a"))
+	first.Annotations = map[string]string{hostnameAnnotation: "app"}
+	second := testIngress("second", "b.example.com", ingressPath("/", v1.PathTypePrefix, "b"))
+	second.CreationTimestamp = metav1.NewTime(time.Now())
+	second.Annotations = map[string]string{hostnameAnnotation: "APP"}
+	third := testIngress("third", "app", ingressPath("/", v1.PathTypePrefix, "c"))
+	third.CreationTimestamp = metav1.NewTime(time.Now().Add(time.Second))
+	c.update(&update{ingresses: []*v1.Ingress{third, second, first}})
+
+	if got := routedTo(c, "a.example.com", "/"); got != "a" {
+		t.Errorf("first host routed to %q, want a", got)
+	}
+	for _, host := range []string{"b.example.com", "app"} {
+		if _, ok := c.hosts[host]; ok {
+			t.Errorf("host %s with a duplicate node hostname was added", host)
+		}
+	}
+	if len(c.nodes) != 1 {
+		t.Errorf("got %d nodes, want 1", len(c.nodes))
+	}
+	var conflicts []string
+	for _, e := range c.errors.recent() {
+		if strings.Contains(e.Message, "node hostname") {
+			conflicts = append(conflicts, e.Host)
+		}
+	}
+	if want := []string{"b.example.com", "app"}; !reflect.DeepEqual(conflicts, want) {
+		t.Errorf("got hostname errors for hosts %v, want %v", conflicts, want)
+	}
+	events := 0
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, "Warning HostnameConflict") {
+			events++
+		}
+	}
+	if events != 2 {
+		t.Errorf("got %d HostnameConflict events, want 2", events)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	c.update(&update{ingresses: []*v1.Ingress{
+		testIngress("a", "a.example.com", ingressPath("/", v1.PathTypePrefix, "a")),
+		testIngress("b", "b.example.com", ingressPath("/", v1.PathTypePrefix, "b")),
+	}})
+	// A node closed earlier that never finishes stopping doesn't hold up the
+	// shutdown past its deadline, nor the lock while waiting for it.
+	stuck, err := c.newNode("stuck", false, timeouts{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.closeNode(stuck)
+	c.stopping[stuck] = true
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdownDone := make(chan struct{})
+	go func() {
+		c.shutdown(ctx)
+		close(shutdownDone)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if !c.mu.TryLock() {
+		t.Error("lock held while waiting for nodes to stop")
+	} else {
+		c.mu.Unlock()
+	}
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't return once its context was done")
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.hosts) != 0 || len(c.nodes) != 0 {
+		t.Errorf("got %d hosts and %d nodes after shutdown, want none", len(c.hosts), len(c.nodes))
+	}
+	if len(c.stopping) != 1 {
+		t.Errorf("got %d nodes stopping, want only the stuck one", len(c.stopping))
+	}
+}
+
+func TestUpdateDuringShutdown(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ingresses := func(i int) []*v1.Ingress {
+		return []*v1.Ingress{
+			testIngress("a", "a.example.com", ingressPath("/", v1.PathTypePrefix, "a")),
+			testIngress(fmt.Sprintf("b%d", i), fmt.Sprintf("b%d.example.com", i), ingressPath("/", v1.PathTypePrefix, "b")),
+		}
+	}
+	c.update(&update{ingresses: ingresses(0)})
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.update(&update{ingresses: ingresses(i)})
+		}(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.shutdown(ctx)
+	wg.Wait()
+	// Updates applied after the shutdown are ignored.
+	c.update(&update{ingresses: ingresses(21)})
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.hosts) != 0 || len(c.nodes) != 0 {
+		t.Errorf("got %d hosts and %d nodes after shutdown, want none", len(c.hosts), len(c.nodes))
+	}
+	for n := range c.stopping {
+		t.Errorf("node %s still stopping after shutdown", n.hostname())
+	}
+}
+
+func TestRecreateNodeDrains(t *testing.T) {
+	c := newTestController(t, controllerConfig{shutdownTimeout: 5 * time.Second})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	c.update(&update{ingresses: []*v1.Ingress{ing}})
+
+	// Stand in for the server of the node, which isn't started in dry run
+	// mode.
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+	c.mu.Lock()
+	old := c.hosts["app.example.com"].node
+	old.httpServer = srv.Config
+	c.mu.Unlock()
+
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("got status %d", resp.StatusCode)
+			}
+		}
+		inFlight <- err
+	}()
+	<-started
+
+	ing = ing.DeepCopy()
+	ing.Spec.TLS = []v1.IngressTLS{{Hosts: []string{"app.example.com"}}}
+	c.update(&update{ingresses: []*v1.Ingress{ing}})
+	c.mu.RLock()
+	recreated := c.hosts["app.example.com"].node != old
+	c.mu.RUnlock()
+	if !recreated {
+		t.Fatal("node wasn't recreated after its TLS setting changed")
+	}
+	select {
+	case <-old.done:
+		t.Fatal("old node stopped with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	select {
+	case <-old.done:
+	case <-time.After(5 * time.Second):
+		t.Error("old node didn't stop once its requests completed")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	for _, tt := range []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"/", "/", true},
+		{"/", "/anything", true},
+		{"/foo", "/foo", true},
+		{"/foo", "/foo/", true},
+		{"/foo", "/foo/bar", true},
+		{"/foo", "/foobar", false},
+		{"/foo", "/fo", false},
+		{"/foo", "/", false},
+		{"/foo/", "/foo", true},
+		{"/foo/", "/foo/bar", true},
+		{"/foo/", "/foobar", false},
+		{"/foo/bar", "/foo/bar/baz", true},
+		{"/foo/bar", "/foo/baz", false},
+		{"/foo/bar", "/foo/barbaz", false},
+	} {
+		p := &hostPath{value: tt.prefix}
+		if got := p.matches(tt.path); got != tt.want {
+			t.Errorf("prefix %s matches %s: got %t, want %t", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+
+	p := &hostPath{value: "/api/v[0-9]+/", pattern: regexp.MustCompile("^(?:/api/v[0-9]+/)")}
+	for path, want := range map[string]bool{"/api/v2/users": true, "/api/v10/": true, "/api/vx/": false, "/v2/api/v2/": false} {
+		if got := p.matches(path); got != want {
+			t.Errorf("expression %s matches %s: got %t, want %t", p.value, path, got, want)
+		}
+	}
+}
+
+func TestMultiplePathsPerHost(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	c.update(&update{ingresses: []*v1.Ingress{testIngress("app", "app.example.com",
+		ingressPath("/exact-a", v1.PathTypeExact, "exact-a"),
+		ingressPath("/exact-b", v1.PathTypeExact, "exact-b"),
+		ingressPath("/a", v1.PathTypePrefix, "prefix-a"),
+		ingressPath("/b", v1.PathTypePrefix, "prefix-b"),
+		ingressPath("/c", v1.PathTypePrefix, "prefix-c"),
+	)}})
+	// Updating again must not lose any path either.
+	for i := 0; i < 2; i++ {
+		for path, want := range map[string]string{
+			"/exact-a": "exact-a",
+			"/exact-b": "exact-b",
+			"/a/x":     "prefix-a",
+			"/b":       "prefix-b",
+			"/c/y/z":   "prefix-c",
+			"/d":       "",
+		} {
+			if got := routedTo(c, "app.example.com", path); got != want {
+				t.Errorf("update %d: %s routed to %q, want %q", i+1, path, got, want)
+			}
+		}
+		c.mu.RLock()
+		h := c.hosts["app.example.com"]
+		if len(h.pathMap) != 2 || len(h.pathPrefixes) != 3 {
+			t.Errorf("update %d: got %d exact and %d prefix paths, want 2 and 3", i+1, len(h.pathMap), len(h.pathPrefixes))
+		}
+		ingresses := h.ingresses
+		c.mu.RUnlock()
+		c.update(&update{ingresses: ingresses})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	body := strings.Repeat("message ", 512)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+		w.(http.Flusher).Flush()
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "OK")
+	})
+	for _, tt := range []struct {
+		name        string
+		annotations map[string]string
+		gzip        bool
+	}{
+		{"plain", nil, false},
+		{"compressed", map[string]string{compressAnnotation: "true"}, true},
+		{"headers", map[string]string{
+			securityHeadersAnnotation: "true",
+			responseHeadersAnnotation: "X-Served-By=tailscale",
+		}, false},
+		{"all", map[string]string{
+			compressAnnotation:        "true",
+			securityHeadersAnnotation: "true",
+			responseHeadersAnnotation: "X-Served-By=tailscale",
+		}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+			ing.Annotations = tt.annotations
+			serveBackend(t, c, ing, backend)
+			srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Asking for gzip explicitly keeps the client from decoding it.
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var r io.Reader = resp.Body
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.gzip {
+				t.Fatalf("got gzip encoding %t, want %t", got, tt.gzip)
+			}
+			if tt.gzip {
+				if r, err = gzip.NewReader(resp.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != body {
+				t.Errorf("got a body of %d bytes, want %d", len(b), len(body))
+			}
+			// Trailers are only known once the body was read.
+			if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+				t.Errorf("got Grpc-Status trailer %q, want 0", got)
+			}
+			if got := resp.Trailer.Get("Grpc-Message"); got != "OK" {
+				t.Errorf("got Grpc-Message trailer %q, want OK", got)
+			}
+			if tt.annotations[securityHeadersAnnotation] != "" && resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+				t.Error("missing security headers")
+			}
+			if tt.annotations[responseHeadersAnnotation] != "" && resp.Header.Get("X-Served-By") != "tailscale" {
+				t.Error("missing response header")
+			}
+		})
+	}
+}
+
+func TestPathPrecedence(t *testing.T) {
+	spa := testIngress("spa", "app.example.com", ingressPath("/", v1.PathTypePrefix, "spa"))
+	api := testIngress("api", "app.example.com",
+		ingressPath("/api", v1.PathTypePrefix, "api"),
+		ingressPath("/api/health", v1.PathTypeExact, "health"),
+	)
+	both := testIngress("both", "app.example.com",
+		ingressPath("/", v1.PathTypePrefix, "spa"),
+		ingressPath("/api/health", v1.PathTypeExact, "health"),
+		ingressPath("/api", v1.PathTypePrefix, "api"),
+	)
+	want := map[string]string{
+		"/":              "spa",
+		"/index.html":    "spa",
+		"/apidocs":       "spa",
+		"/api":           "api",
+		"/api/users":     "api",
+		"/api/health":    "health",
+		"/api/health/db": "api",
+	}
+	for name, ingresses := range map[string][]*v1.Ingress{
+		"one ingress": {both},
+		"spa first":   {spa, api},
+		"api first":   {api, spa},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			c.update(&update{ingresses: ingresses})
+			for path, want := range want {
+				if got := routedTo(c, "app.example.com", path); got != want {
+					t.Errorf("%s routed to %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveClusterIP(t *testing.T) {
+	clusterIP := testService("cluster-ip")
+	headless := testService("headless")
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+	external := testService("external")
+	external.Spec.Type = corev1.ServiceTypeExternalName
+	external.Spec.ExternalName = "app.example.org"
+	external.Spec.ClusterIP = ""
+	client := fake.NewSimpleClientset(clusterIP, headless, external)
+
+	cfg := controllerConfig{resolveClusterIP: true, reconcileDebounce: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *update, 1)
+	go listen(ctx, client, nil, cfg, func(u *update) {
+		select {
+		case updates <- u:
+		default:
+		}
+	})
+	var u *update
+	select {
+	case u = <-updates:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the caches to sync")
+	}
+	u.ingresses = []*v1.Ingress{testIngress("app", "app.example.com",
+		ingressPath("/cluster-ip", v1.PathTypePrefix, "cluster-ip"),
+		ingressPath("/headless", v1.PathTypePrefix, "headless"),
+		ingressPath("/external", v1.PathTypePrefix, "external"),
+		ingressPath("/missing", v1.PathTypePrefix, "missing"),
+	)}
+	c := newTestController(t, cfg)
+	c.update(u)
+
+	for path, want := range map[string]string{
+		"/cluster-ip": "10.0.0.1:80",
+		"/headless":   "headless.default.svc:80",
+		"/external":   "app.example.org:80",
+		"/missing":    "missing.default.svc:80",
+	} {
+		p, err := c.getHostPath("app.example.com", path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got := p.backendHost(); got != want {
+			t.Errorf("%s dials %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestMissingNamedPort(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	named := ingressPath("/named", v1.PathTypePrefix, "web")
+	named.Backend.Service.Port = v1.ServiceBackendPort{Name: "http"}
+	ing := testIngress("app", "app.example.com", named, ingressPath("/", v1.PathTypePrefix, "web"))
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+	// The Service web has a single unnamed port.
+	for path, want := range map[string]int{"/named": http.StatusBadGateway, "/": http.StatusOK} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got status %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+
+	for addr, wantErr := range map[string]bool{
+		"web.default.svc:80": false,
+		"10.0.0.1:8080":      false,
+		"web.default.svc:0":  true,
+		"web.default.svc:":   true,
+		":80":                true,
+		"web.default.svc":    true,
+	} {
+		if err := checkBackendAddr(&url.URL{Host: addr}); (err != nil) != wantErr {
+			t.Errorf("checkBackendAddr(%q): got error %v, want error %t", addr, err, wantErr)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		exact   bool
+		pattern bool
+		target  string
+		path    string
+		want    string
+	}{
+		{"/api", false, false, "/", "/api", "/"},
+		{"/api", false, false, "/", "/api/", "/"},
+		{"/api", false, false, "/", "/api/users?id=1", "/users?id=1"},
+		{"/api/", false, false, "/v2", "/api/users", "/v2/users"},
+		{"/api/", false, false, "/v2/", "/api", "/v2/"},
+		{"/", false, false, "/app", "/users", "/app/users"},
+		{"/api", false, false, "/", "/api/a%2Fb", "/a%2Fb"},
+		{"/health", true, false, "/healthz", "/health", "/healthz"},
+		{"/app/(.*)", false, true, "/$1", "/app/x/y", "/x/y"},
+		{"/v[0-9]+", false, true, "/api", "/v1/users", "/api/users"},
+		{"/(?P<name>[a-z]+)/x", false, true, "/${name}", "/abc/x/y", "/abc/y"},
+	} {
+		p := &hostPath{value: tt.value, exact: tt.exact, options: &pathOptions{rewriteTarget: tt.target}}
+		if tt.pattern {
+			p.pattern = regexp.MustCompile("^(?:" + tt.value + ")")
+		}
+		u, err := url.Parse(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.rewritePath(u)
+		if got := u.RequestURI(); got != tt.want {
+			t.Errorf("%s rewritten to %s for %s: got %s, want %s", tt.path, tt.target, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com",
+		ingressPath("/", v1.PathTypePrefix, "web"),
+		ingressPath("/down", v1.PathTypePrefix, "down"),
+	)
+	ing.Annotations = map[string]string{securityHeadersAnnotation: "true"}
+	svc, eps := testBackend(t, "web", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/framed" {
+			w.Header().Set("X-Frame-Options", "DENY")
+		}
+	}))
+	// Nothing listens on the port of the endpoint of down anymore.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	c.update(&update{
+		ingresses:      []*v1.Ingress{ing},
+		services:       []*corev1.Service{svc, testService("down")},
+		endpointSlices: []*discoveryv1.EndpointSlice{eps, testEndpoints("down", l.Addr().(*net.TCPAddr).Port)},
+	})
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+	for _, tt := range []struct {
+		path        string
+		code        int
+		frameOption string
+	}{
+		{"/", http.StatusOK, "SAMEORIGIN"},
+		{"/framed", http.StatusOK, "DENY"},
+		{"/down", http.StatusBadGateway, "SAMEORIGIN"},
+	} {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.path, resp.StatusCode, tt.code)
+		}
+		if got := resp.Header.Get("X-Frame-Options"); got != tt.frameOption {
+			t.Errorf("%s: got X-Frame-Options %q, want %q", tt.path, got, tt.frameOption)
+		}
+		for k, v := range securityHeaders(false) {
+			if k == "X-Frame-Options" {
+				continue
+			}
+			if got := resp.Header.Get(k); got != v[0] {
+				t.Errorf("%s: got %s %q, want %q", tt.path, k, got, v[0])
+			}
+		}
+		if got := resp.Header.Get("Strict-Transport-Security"); got != "" {
+			t.Errorf("%s: got Strict-Transport-Security %q without TLS", tt.path, got)
+		}
+	}
+}
+
+func TestUpgradePastTimeouts(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	c.mu.RLock()
+	n := c.hosts["app.example.com"].node
+	c.mu.RUnlock()
+	// Stand in for the server of the node, with timeouts far shorter than the
+	// connection is kept open.
+	srv := httptest.NewUnstartedServer(c.newHandler(n, fakeWhoIs{}))
+	srv.Config.ReadTimeout = 100 * time.Millisecond
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app.example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want 101", resp.StatusCode)
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		msg := fmt.Sprintf("message %d\n", i)
+		if _, err := io.WriteString(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read echo after %d messages: %v", i, err)
+		}
+		if got != msg {
+			t.Errorf("got echo %q, want %q", got, msg)
+		}
+	}
+}
+
+func TestSharedHost(t *testing.T) {
+	older := testIngress("older", "app.example.com",
+		ingressPath("/api", v1.PathTypePrefix, "old"),
+		ingressPath("/same", v1.PathTypePrefix, "same"),
+	)
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	newer := testIngress("newer", "app.example.com",
+		ingressPath("/api", v1.PathTypePrefix, "new"),
+		ingressPath("/same", v1.PathTypePrefix, "same"),
+		ingressPath("/web", v1.PathTypePrefix, "web"),
+	)
+	newer.CreationTimestamp = metav1.Now()
+	newer.Spec.TLS = []v1.IngressTLS{{Hosts: []string{"app.example.com"}}}
+
+	for name, ingresses := range map[string][]*v1.Ingress{
+		"older first": {older, newer},
+		"newer first": {newer, older},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+			c.update(&update{ingresses: ingresses})
+
+			for path, want := range map[string]string{"/api": "old", "/same": "same", "/web": "web"} {
+				if got := routedTo(c, "app.example.com", path); got != want {
+					t.Errorf("%s routed to %q, want %q", path, got, want)
+				}
+			}
+			c.mu.RLock()
+			useTls := c.hosts["app.example.com"].node.useTls
+			c.mu.RUnlock()
+			if !useTls {
+				t.Error("host doesn't use TLS, which the newer ingress enables")
+			}
+
+			var conflicts []string
+			for _, e := range c.errors.recent() {
+				if e.Kind == errorKindConfig {
+					conflicts = append(conflicts, e.Message)
+				}
+			}
+			if len(conflicts) != 1 || !strings.Contains(conflicts[0], "default/newer conflicts with ingress default/older") {
+				t.Errorf("got conflicts %q, want one for /api", conflicts)
+			}
+			events := 0
+			for len(recorder.Events) > 0 {
+				if strings.Contains(<-recorder.Events, "Warning PathConflict") {
+					events++
+				}
+			}
+			if events != 1 {
+				t.Errorf("got %d PathConflict events, want 1", events)
+			}
+		})
+	}
+}
+
+func TestConflictingDefaultBackends(t *testing.T) {
+	defaultBackend := func(service string) *v1.IngressBackend {
+		return &v1.IngressBackend{Service: &v1.IngressServiceBackend{Name: service, Port: v1.ServiceBackendPort{Number: 80}}}
+	}
+	older := testIngress("older", "app.example.com", ingressPath("/api", v1.PathTypePrefix, "api"))
+	older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	older.Spec.DefaultBackend = defaultBackend("old-default")
+	newer := testIngress("newer", "app.example.com", ingressPath("/web", v1.PathTypePrefix, "web"))
+	newer.CreationTimestamp = metav1.Now()
+	newer.Spec.DefaultBackend = defaultBackend("new-default")
+
+	for name, ingresses := range map[string][]*v1.Ingress{
+		"older first": {older, newer},
+		"newer first": {newer, older},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+			c.update(&update{ingresses: ingresses})
+			for path, want := range map[string]string{"/api": "api", "/web": "web", "/other": "old-default"} {
+				if got := routedTo(c, "app.example.com", path); got != want {
+					t.Errorf("%s routed to %q, want %q", path, got, want)
+				}
+			}
+			events := 0
+			for len(recorder.Events) > 0 {
+				if strings.Contains(<-recorder.Events, "Warning DefaultBackendIgnored") {
+					events++
+				}
+			}
+			if events != 1 {
+				t.Errorf("got %d DefaultBackendIgnored events, want 1", events)
+			}
+
+			// Once the oldest Ingress is deleted, the default backend of the
+			// other one takes over.
+			c.update(&update{ingresses: []*v1.Ingress{newer}})
+			for path, want := range map[string]string{"/api": "new-default", "/web": "web", "/other": "new-default"} {
+				if got := routedTo(c, "app.example.com", path); got != want {
+					t.Errorf("after deleting the oldest ingress, %s routed to %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodedPathPreserved(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.RequestURI, r.URL.RawPath)
+	}))
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+	for _, uri := range []string{
+		"/files/a%2Fb.txt",
+		"/files/a%2fb%20c?sig=x%2By%3D&q=1",
+		"/%E2%82%AC/a%2F%2Fb/",
+	} {
+		resp, err := http.Get(srv.URL + uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		requestURI, rawPath, _ := strings.Cut(string(b), "|")
+		if requestURI != uri {
+			t.Errorf("backend got request URI %s, want %s", requestURI, uri)
+		}
+		path, _, _ := strings.Cut(uri, "?")
+		if rawPath != path {
+			t.Errorf("backend got raw path %q, want %s", rawPath, path)
+		}
+	}
+}
+
+func TestPreserveHost(t *testing.T) {
+	for _, tt := range []struct {
+		annotation string
+		want       string
+	}{
+		{"", "web.default.svc:80"},
+		{"false", "web.default.svc:80"},
+		{"true", "app.example.com"},
+	} {
+		c := newTestController(t, controllerConfig{})
+		ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+		if tt.annotation != "" {
+			ing.Annotations = map[string]string{preserveHostAnnotation: tt.annotation}
+		}
+		serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host)
+		}))
+		srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := string(b); got != tt.want {
+			t.Errorf("preserve-host %q: backend got Host %s, want %s", tt.annotation, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	for _, useTls := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tls %t", useTls), func(t *testing.T) {
+			c := newTestController(t, controllerConfig{})
+			multi := testIngress("multi", "a.b.example", ingressPath("/", v1.PathTypePrefix, "web"))
+			named := testIngress("named", "grafana.internal", ingressPath("/", v1.PathTypePrefix, "web"))
+			named.Annotations = map[string]string{hostnameAnnotation: "grafana"}
+			other := testIngress("other", "a.b", ingressPath("/", v1.PathTypePrefix, "web"))
+			ingresses := []*v1.Ingress{multi, named, other}
+			if useTls {
+				for _, ing := range ingresses {
+					ing.Spec.TLS = []v1.IngressTLS{{Hosts: []string{ing.Spec.Rules[0].Host}}}
+				}
+			}
+			c.update(&update{ingresses: ingresses})
+			c.mu.RLock()
+			nodes := map[string]*node{}
+			for host, h := range c.hosts {
+				nodes[host] = h.node
+				if h.node.useTls != useTls {
+					t.Errorf("host %s uses TLS %t, want %t", host, h.node.useTls, useTls)
+				}
+			}
+			c.mu.RUnlock()
+
+			for _, tt := range []struct {
+				node, requestHost, want string
+			}{
+				{"a.b.example", "a.b.example", "a.b.example"},
+				{"a.b.example", "a.b.example:443", "a.b.example"},
+				{"a.b.example", "a.b.example.tailnet.ts.net", "a.b.example"},
+				{"a.b.example", "a.b.example.tailnet.ts.net:443", "a.b.example"},
+				{"a.b.example", "a.b.example.tailnet.ts.net.", "a.b.example"},
+				// a.b is served by another node.
+				{"a.b.example", "a.b.tailnet.ts.net", "a.b.tailnet.ts.net"},
+				{"a.b", "a.b.tailnet.ts.net", "a.b"},
+				{"a.b", "a.b.tailnet.ts.net:80", "a.b"},
+				{"grafana.internal", "grafana.internal", "grafana.internal"},
+				{"grafana.internal", "grafana.internal.tailnet.ts.net", "grafana.internal"},
+				{"grafana.internal", "grafana.tailnet.ts.net", "grafana.internal"},
+				{"grafana.internal", "grafana.tailnet.ts.net:443", "grafana.internal"},
+				{"grafana.internal", "grafana", "grafana.internal"},
+				{"grafana.internal", "unknown.tailnet.ts.net:443", "unknown.tailnet.ts.net"},
+			} {
+				if got := c.matchHost(nodes[tt.node], tt.requestHost); got != tt.want {
+					t.Errorf("node of %s matched %s to %q, want %q", tt.node, tt.requestHost, got, tt.want)
+				}
+			}
+		})
+	}
+}
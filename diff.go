@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// routes is a snapshot of the desired routing state: the backend of every path
+// keyed by host and then by path.
+type routes map[string]map[string]string
+
+func (c *controller) snapshotRoutes() routes {
+	r := make(routes, len(c.hosts))
+	for n, h := range c.hosts {
+		paths := make(map[string]string)
+		for _, p := range h.pathMap {
+			paths[p.key()] = p.backend.String()
+		}
+		for _, p := range h.pathPrefixes {
+			paths[p.key()] = p.backend.String()
+		}
+		if h.defaultPath != nil {
+			paths["(default)"] = h.defaultPath.backend.String()
+		}
+		r[n] = paths
+	}
+	return r
+}
+
+func (p *hostPath) key() string {
+	switch {
+	case p.exact:
+		return p.value + " (exact)"
+	case p.pattern != nil:
+		return p.value + " (regex)"
+	}
+	return p.value + " (prefix)"
+}
+
+// logRoutes logs every path of a snapshot.
+func logRoutes(r routes) {
+	for _, h := range sortedKeys(r) {
+		for _, p := range sortedKeys(r[h]) {
+			log.Printf("route: %s %s -> %s", h, p, r[h][p])
+		}
+	}
+}
+
+// logRoutesDiff logs the hosts and paths that differ between two snapshots.
+func logRoutesDiff(prev, next routes) {
+	for _, line := range diffRoutes(prev, next) {
+		log.Println(line)
+	}
+}
+
+// diffRoutes describes the hosts and paths that differ between two snapshots,
+// one change per line.
+func diffRoutes(prev, next routes) []string {
+	var diff []string
+	for _, h := range sortedKeys(next) {
+		if _, ok := prev[h]; !ok {
+			diff = append(diff, fmt.Sprintf("host added: %s", h))
+		}
+		for _, p := range sortedKeys(next[h]) {
+			old, ok := prev[h][p]
+			if !ok {
+				diff = append(diff, fmt.Sprintf("path added: %s %s -> %s", h, p, next[h][p]))
+			} else if old != next[h][p] {
+				diff = append(diff, fmt.Sprintf("path changed: %s %s -> %s (was %s)", h, p, next[h][p], old))
+			}
+		}
+		for _, p := range sortedKeys(prev[h]) {
+			if _, ok := next[h][p]; !ok {
+				diff = append(diff, fmt.Sprintf("path removed: %s %s", h, p))
+			}
+		}
+	}
+	for _, h := range sortedKeys(prev) {
+		if _, ok := next[h]; !ok {
+			diff = append(diff, fmt.Sprintf("host removed: %s", h))
+		}
+	}
+	return diff
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
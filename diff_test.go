@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	prev := routes{
+		"old.example.com": {"/ (prefix)": "http://old.default.svc:80"},
+		"app.example.com": {
+			"/ (prefix)":    "http://web.default.svc:80",
+			"/api (prefix)": "http://api.default.svc:80",
+		},
+	}
+	next := routes{
+		"new.example.com": {"/ (prefix)": "http://new.default.svc:80"},
+		"app.example.com": {
+			"/ (prefix)":      "http://web.default.svc:8080",
+			"/health (exact)": "http://api.default.svc:80",
+		},
+	}
+	want := []string{
+		"path changed: app.example.com / (prefix) -> http://web.default.svc:8080 (was http://web.default.svc:80)",
+		"path added: app.example.com /health (exact) -> http://api.default.svc:80",
+		"path removed: app.example.com /api (prefix)",
+		"host added: new.example.com",
+		"path added: new.example.com / (prefix) -> http://new.default.svc:80",
+		"host removed: old.example.com",
+	}
+	if got := diffRoutes(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("got diff\n%q\nwant\n%q", got, want)
+	}
+	if got := diffRoutes(next, next); len(got) != 0 {
+		t.Errorf("got diff %q for unchanged routes, want none", got)
+	}
+}
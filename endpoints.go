@@ -0,0 +1,117 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/api/networking/v1"
+	"net"
+	"strconv"
+)
+
+// serviceKey identifies a Service by namespace and name.
+type serviceKey struct {
+	namespace, name string
+}
+
+// indexServices indexes Services and their EndpointSlices by Service.
+func indexServices(services []*corev1.Service, slices []*discoveryv1.EndpointSlice) (map[serviceKey]*corev1.Service, map[serviceKey][]*discoveryv1.EndpointSlice) {
+	svcs := make(map[serviceKey]*corev1.Service, len(services))
+	for _, s := range services {
+		svcs[serviceKey{s.Namespace, s.Name}] = s
+	}
+	eps := make(map[serviceKey][]*discoveryv1.EndpointSlice)
+	for _, s := range slices {
+		name, ok := s.Labels[discoveryv1.LabelServiceName]
+		if !ok {
+			continue
+		}
+		k := serviceKey{s.Namespace, name}
+		eps[k] = append(eps[k], s)
+	}
+	return svcs, eps
+}
+
+// servicePort returns the number of the given port of a Service, looking it
+// up by name if needed, or 0 if the Service has no such port.
+func servicePort(svc *corev1.Service, port v1.ServiceBackendPort) int32 {
+	if port.Name == "" {
+		return port.Number
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name == port.Name {
+			return p.Port
+		}
+	}
+	return 0
+}
+
+// readyEndpoints returns the addresses of the ready endpoints behind the given
+// port of a Service.
+func readyEndpoints(svc *corev1.Service, port v1.ServiceBackendPort, slices []*discoveryv1.EndpointSlice) []string {
+	// Endpoint ports are named after the Service port they belong to.
+	var portName string
+	found := false
+	for _, p := range svc.Spec.Ports {
+		if (port.Name != "" && p.Name == port.Name) || (port.Name == "" && p.Port == port.Number) {
+			portName = p.Name
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+	var addrs []string
+	for _, s := range slices {
+		if s.AddressType != discoveryv1.AddressTypeIPv4 && s.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+		var targetPort int32
+		for _, p := range s.Ports {
+			name := ""
+			if p.Name != nil {
+				name = *p.Name
+			}
+			if name == portName && p.Port != nil {
+				targetPort = *p.Port
+				break
+			}
+		}
+		if targetPort == 0 {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, a := range e.Addresses {
+				addrs = append(addrs, net.JoinHostPort(a, strconv.Itoa(int(targetPort))))
+			}
+		}
+	}
+	return addrs
+}
+
+// backendHost returns the address to dial for a request, going round-robin
+// over the ready endpoints, or the Service address if there are none.
+func (p *hostPath) backendHost() string {
+	if len(p.endpoints) == 0 {
+		if p.clusterIP != "" {
+			return p.clusterIP
+		}
+		return p.backend.Host
+	}
+	i := p.next.Add(1) - 1
+	return p.endpoints[i%uint64(len(p.endpoints))]
+}
+
+// retryHost returns the address to send a request to again after it failed on
+// failed: another ready endpoint if there is one.
+func (p *hostPath) retryHost(failed string) string {
+	for range p.endpoints {
+		if h := p.backendHost(); h != failed {
+			return h
+		}
+	}
+	return p.backendHost()
+}
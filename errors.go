@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const maxRecentErrors = 100
+
+// The kinds of reconcile errors, which label the errors metric.
+const (
+	// errorKindConfig is an invalid or conflicting Ingress.
+	errorKindConfig = "config"
+	// errorKindService is a missing backend Service.
+	errorKindService = "service"
+	// errorKindNode is a node failing to start, serve or stop.
+	errorKindNode = "node"
+	// errorKindAuth is an auth key rejected by the control server.
+	errorKindAuth = "auth"
+	// errorKindTags is a failure to apply the ACL tags of a node.
+	errorKindTags = "tags"
+	// errorKindStatus is a failure to write the status of an Ingress.
+	errorKindStatus = "status"
+)
+
+type reconcileError struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Host    string    `json:"host,omitempty"`
+	Message string    `json:"message"`
+}
+
+// errorLog is a bounded ring buffer of the most recent reconcile errors.
+type errorLog struct {
+	mu      sync.Mutex
+	entries []reconcileError
+	next    int
+}
+
+func (l *errorLog) add(e reconcileError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < maxRecentErrors {
+		l.entries = append(l.entries, e)
+		return
+	}
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % maxRecentErrors
+}
+
+// recent returns the recorded errors, oldest first.
+func (l *errorLog) recent() []reconcileError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := make([]reconcileError, 0, len(l.entries))
+	r = append(r, l.entries[l.next:]...)
+	return append(r, l.entries[:l.next]...)
+}
+
+// recordError logs a reconcile error of the given kind, counts it and keeps it
+// for the /debug/errors endpoint.
+func (c *controller) recordError(kind, host, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if host != "" {
+		log.Printf("%s: %s", host, msg)
+	} else {
+		log.Println(msg)
+	}
+	reconcileErrorsTotal.WithLabelValues(kind).Inc()
+	c.errors.add(reconcileError{Time: time.Now(), Kind: kind, Host: host, Message: msg})
+}
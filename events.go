@@ -0,0 +1,43 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// newEventRecorder returns a recorder for the Events emitted on ingresses,
+// and a function stopping it.
+func newEventRecorder(client kubernetes.Interface) (record.EventRecorder, func()) {
+	b := record.NewBroadcaster()
+	b.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return b.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "tailscale-ingress-controller"}), b.Shutdown
+}
+
+// event emits an Event on ing, unless it was translated from an HTTPRoute.
+func (c *controller) event(ing *v1.Ingress, eventType, reason, format string, args ...any) {
+	if c.recorder == nil || ing.Kind == httpRouteKind {
+		return
+	}
+	c.recorder.Eventf(ing, eventType, reason, format, args...)
+}
+
+// nodeEvent emits an Event on the ingresses of the hosts served by n. c.mu
+// must be held.
+func (c *controller) nodeEvent(n *node, eventType, reason, format string, args ...any) {
+	seen := make(map[*v1.Ingress]bool)
+	for _, h := range c.hosts {
+		if h.node != n {
+			continue
+		}
+		for _, ing := range h.ingresses {
+			if !seen[ing] {
+				seen[ing] = true
+				c.event(ing, eventType, reason, format, args...)
+			}
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"log"
+)
+
+// The Gateway API resources, which are watched without typed clients as they
+// are CRDs.
+var (
+	gatewayClassesResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "gatewayclasses"}
+	gatewaysResource       = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "gateways"}
+	httpRoutesResource     = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1beta1", Resource: "httproutes"}
+)
+
+// checkGatewayAPI returns an error unless the Gateway API resources are served
+// by the API server, without which their informers would never sync.
+func checkGatewayAPI(d discovery.DiscoveryInterface) error {
+	gv := gatewayClassesResource.GroupVersion().String()
+	list, err := d.ServerResourcesForGroupVersion(gv)
+	if err != nil {
+		return fmt.Errorf("failed to find the Gateway API %s, check that its CRDs are installed: %w", gv, err)
+	}
+	served := make(map[string]bool)
+	for _, r := range list.APIResources {
+		served[r.Name] = true
+	}
+	for _, r := range []schema.GroupVersionResource{gatewayClassesResource, gatewaysResource, httpRoutesResource} {
+		if !served[r.Resource] {
+			return fmt.Errorf("the Gateway API resource %s isn't served, check that its CRD is installed", r.GroupResource())
+		}
+	}
+	return nil
+}
+
+// httpRouteKind is the kind of the ingresses translated from HTTPRoutes,
+// which have no status to write.
+const httpRouteKind = "HTTPRoute"
+
+type gatewayClass struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ControllerName string `json:"controllerName"`
+	} `json:"spec"`
+}
+
+type gateway struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		GatewayClassName string `json:"gatewayClassName"`
+		Listeners        []struct {
+			Name     string `json:"name"`
+			Hostname string `json:"hostname"`
+			Protocol string `json:"protocol"`
+		} `json:"listeners"`
+	} `json:"spec"`
+}
+
+type httpRoute struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		ParentRefs []struct {
+			Kind        string `json:"kind"`
+			Namespace   string `json:"namespace"`
+			Name        string `json:"name"`
+			SectionName string `json:"sectionName"`
+		} `json:"parentRefs"`
+		Hostnames []string `json:"hostnames"`
+		Rules     []struct {
+			Matches     []httpRouteMatch `json:"matches"`
+			BackendRefs []httpBackendRef `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type httpRouteMatch struct {
+	Path *struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"path"`
+	Headers     []any  `json:"headers"`
+	QueryParams []any  `json:"queryParams"`
+	Method      string `json:"method"`
+}
+
+type httpBackendRef struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Port      int32  `json:"port"`
+}
+
+func fromUnstructured[T any](objs []runtime.Object) []*T {
+	var out []*T
+	for _, o := range objs {
+		u, ok := o.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		t := new(T)
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, t); err != nil {
+			log.Printf("ignoring invalid %s %s/%s: %v", u.GetKind(), u.GetNamespace(), u.GetName(), err)
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// routeReferencesService reports whether an HTTPRoute routes to the service
+// name in its namespace.
+func routeReferencesService(obj runtime.Object, name string) bool {
+	routes := fromUnstructured[httpRoute]([]runtime.Object{obj})
+	if len(routes) == 0 {
+		return false
+	}
+	for _, rule := range routes[0].Spec.Rules {
+		for _, ref := range rule.BackendRefs {
+			if ref.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingressesFromRoutes translates the HTTPRoutes attached to Gateways of a
+// GatewayClass naming the controller into ingresses of the configured class,
+// so that they are handled like any other. Matches on anything but the path,
+// backends other than a single Service in the namespace of the route and
+// routes without hostnames are ignored.
+func (c controllerConfig) ingressesFromRoutes(classObjs, gatewayObjs, routeObjs []runtime.Object) []*v1.Ingress {
+	ourClasses := make(map[string]bool)
+	for _, gc := range fromUnstructured[gatewayClass](classObjs) {
+		if gc.Spec.ControllerName == controllerName {
+			ourClasses[gc.Name] = true
+		}
+	}
+	gateways := make(map[serviceKey]*gateway)
+	for _, gw := range fromUnstructured[gateway](gatewayObjs) {
+		if ourClasses[gw.Spec.GatewayClassName] {
+			gateways[serviceKey{gw.Namespace, gw.Name}] = gw
+		}
+	}
+
+	var ingresses []*v1.Ingress
+	for _, route := range fromUnstructured[httpRoute](routeObjs) {
+		attached := false
+		useTls := false
+		var listenerHosts []string
+		for _, ref := range route.Spec.ParentRefs {
+			if ref.Kind != "" && ref.Kind != "Gateway" {
+				continue
+			}
+			ns := ref.Namespace
+			if ns == "" {
+				ns = route.Namespace
+			}
+			gw, ok := gateways[serviceKey{ns, ref.Name}]
+			if !ok {
+				continue
+			}
+			for _, l := range gw.Spec.Listeners {
+				if ref.SectionName != "" && l.Name != ref.SectionName {
+					continue
+				}
+				attached = true
+				if l.Protocol == "HTTPS" {
+					useTls = true
+				}
+				if l.Hostname != "" {
+					listenerHosts = append(listenerHosts, l.Hostname)
+				}
+			}
+		}
+		if !attached {
+			continue
+		}
+		if ing := c.ingressFromRoute(route, useTls, listenerHosts); ing != nil {
+			ingresses = append(ingresses, ing)
+		}
+	}
+	return ingresses
+}
+
+func (c controllerConfig) ingressFromRoute(route *httpRoute, useTls bool, listenerHosts []string) *v1.Ingress {
+	name := route.Namespace + "/" + route.Name
+	hosts := route.Spec.Hostnames
+	if len(hosts) == 0 {
+		hosts = listenerHosts
+	}
+	if len(hosts) == 0 {
+		log.Printf("ignoring HTTPRoute %s without hostnames", name)
+		return nil
+	}
+
+	var paths []v1.HTTPIngressPath
+	for i, rule := range route.Spec.Rules {
+		backend, err := routeBackend(route, rule.BackendRefs)
+		if err != nil {
+			log.Printf("ignoring rule %d of HTTPRoute %s: %v", i, name, err)
+			continue
+		}
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []httpRouteMatch{{}}
+		}
+		for _, m := range matches {
+			if len(m.Headers) > 0 || len(m.QueryParams) > 0 || m.Method != "" {
+				log.Printf("ignoring match of rule %d of HTTPRoute %s on headers, query parameters or method", i, name)
+				continue
+			}
+			pathType, value := v1.PathTypePrefix, "/"
+			if m.Path != nil {
+				if m.Path.Value != "" {
+					value = m.Path.Value
+				}
+				switch m.Path.Type {
+				case "", "PathPrefix":
+				case "Exact":
+					pathType = v1.PathTypeExact
+				case "RegularExpression":
+					pathType = v1.PathTypeImplementationSpecific
+				default:
+					log.Printf("ignoring match of rule %d of HTTPRoute %s with path type %s", i, name, m.Path.Type)
+					continue
+				}
+			}
+			pt := pathType
+			paths = append(paths, v1.HTTPIngressPath{Path: value, PathType: &pt, Backend: backend})
+		}
+	}
+
+	class := c.ingressClass
+	ing := &v1.Ingress{
+		TypeMeta:   metav1.TypeMeta{Kind: httpRouteKind},
+		ObjectMeta: route.ObjectMeta,
+		Spec:       v1.IngressSpec{IngressClassName: &class},
+	}
+	for _, h := range hosts {
+		ing.Spec.Rules = append(ing.Spec.Rules, v1.IngressRule{
+			Host:             h,
+			IngressRuleValue: v1.IngressRuleValue{HTTP: &v1.HTTPIngressRuleValue{Paths: paths}},
+		})
+	}
+	if useTls {
+		ing.Spec.TLS = []v1.IngressTLS{{Hosts: hosts}}
+	}
+	return ing
+}
+
+// routeBackend returns the backend of a rule, which must be a single Service
+// in the namespace of the route.
+func routeBackend(route *httpRoute, refs []httpBackendRef) (v1.IngressBackend, error) {
+	if len(refs) != 1 {
+		return v1.IngressBackend{}, fmt.Errorf("%d backends instead of 1", len(refs))
+	}
+	ref := refs[0]
+	if ref.Kind != "" && ref.Kind != "Service" {
+		return v1.IngressBackend{}, fmt.Errorf("backend of kind %s", ref.Kind)
+	}
+	if ref.Namespace != "" && ref.Namespace != route.Namespace {
+		return v1.IngressBackend{}, fmt.Errorf("backend in namespace %s", ref.Namespace)
+	}
+	return v1.IngressBackend{Service: &v1.IngressServiceBackend{
+		Name: ref.Name,
+		Port: v1.ServiceBackendPort{Number: ref.Port},
+	}}, nil
+}
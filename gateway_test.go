@@ -0,0 +1,34 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestCheckGatewayAPI(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		wantErr   bool
+	}{
+		{"no CRDs", nil, true},
+		{"missing HTTPRoute CRD", []*metav1.APIResourceList{{
+			GroupVersion: "gateway.networking.k8s.io/v1beta1",
+			APIResources: []metav1.APIResource{{Name: "gatewayclasses"}, {Name: "gateways"}},
+		}}, true},
+		{"CRDs installed", []*metav1.APIResourceList{{
+			GroupVersion: "gateway.networking.k8s.io/v1beta1",
+			APIResources: []metav1.APIResource{{Name: "gatewayclasses"}, {Name: "gateways"}, {Name: "httproutes"}},
+		}}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := fake.NewSimpleClientset().Discovery().(*fakediscovery.FakeDiscovery)
+			d.Resources = tt.resources
+			if err := checkGatewayAPI(d); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"k8s.io/api/networking/v1"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetHeadersCopies(t *testing.T) {
+	add := parseResponseHeaders("Vary=Origin\nVary=Cookie\nVary=Authorization")
+	want := append([]string(nil), add["Vary"]...)
+	for _, v := range []string{"Accept-Encoding", "Accept-Language"} {
+		h := http.Header{}
+		setHeaders(h, add, false)
+		h.Add("Vary", v)
+		if got := h["Vary"]; !reflect.DeepEqual(got, append(want, v)) {
+			t.Errorf("got Vary %q, want %q", got, append(want, v))
+		}
+	}
+	if !reflect.DeepEqual(add["Vary"], want) {
+		t.Errorf("setHeaders changed the added headers to %q", add["Vary"])
+	}
+}
+
+// TestResponseHeadersConcurrent is meant to be run with -race: compressing
+// responses appends to the Vary header set from the annotation.
+func TestResponseHeadersConcurrent(t *testing.T) {
+	body := strings.Repeat("hello ", 512)
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	ing.Annotations = map[string]string{
+		compressAnnotation:        "true",
+		responseHeadersAnnotation: "Vary=Origin\nVary=Cookie\nVary=Authorization",
+	}
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+	want := []string{"Origin", "Cookie", "Authorization", "Accept-Encoding"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Values("Vary"); !reflect.DeepEqual(got, want) {
+				t.Errorf("got Vary %q, want %q", got, want)
+			}
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if b, err := io.ReadAll(gr); err != nil || string(b) != body {
+				t.Errorf("got a body of %d bytes (%v), want %d", len(b), err, len(body))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,35 @@
+//go:build !go1.20
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// forwardInformational returns r with a client trace that relays 1xx
+// responses from the backend, such as 103 Early Hints, to w. httputil's
+// ReverseProxy does this itself from Go 1.20.
+func forwardInformational(w http.ResponseWriter, r *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// net/http sends 100 Continue itself once the body is read.
+			if code == http.StatusContinue {
+				return nil
+			}
+			h := w.Header()
+			for k, vv := range header {
+				h[k] = append(h[k], vv...)
+			}
+			w.WriteHeader(code)
+			// WriteHeader doesn't clear the headers of 1xx responses, so do it
+			// here to keep them out of the final response.
+			for k := range h {
+				delete(h, k)
+			}
+			return nil
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
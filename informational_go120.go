@@ -0,0 +1,11 @@
+//go:build go1.20
+
+package main
+
+import "net/http"
+
+// forwardInformational is a no-op since httputil's ReverseProxy relays 1xx
+// responses itself from Go 1.20.
+func forwardInformational(_ http.ResponseWriter, r *http.Request) *http.Request {
+	return r
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"k8s.io/api/networking/v1"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestInformationalResponses covers forwardInformational with Go 1.19, and
+// the relaying httputil does itself from Go 1.20.
+func TestInformationalResponses(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// Reading the body sends 100 Continue.
+			n, _ := io.Copy(io.Discard, r.Body)
+			if n != 1<<20 {
+				t.Errorf("backend got a body of %d bytes", n)
+			}
+			return
+		}
+		w.Header().Add("Link", "</style.css>; rel=preload; as=style")
+		w.Header().Add("Link", "</script.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		io.WriteString(w, "hello")
+	}))
+	srv := serveHost(t, c, "app.example.com", fakeWhoIs{})
+
+	// do sends a request and returns the codes and headers of the 1xx
+	// responses received before the final one.
+	do := func(req *http.Request) ([]int, []textproto.MIMEHeader, *http.Response) {
+		var codes []int
+		var headers []textproto.MIMEHeader
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				headers = append(headers, header)
+				return nil
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
+		client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return codes, headers, resp
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, headers, resp := do(req)
+	if !reflect.DeepEqual(codes, []int{http.StatusEarlyHints}) {
+		t.Fatalf("got 1xx responses %v, want a single 103", codes)
+	}
+	want := []string{"</style.css>; rel=preload; as=style", "</script.js>; rel=preload; as=script"}
+	if got := headers[0].Values("Link"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got Link headers %q on the 103, want %q", got, want)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Link") != "" {
+		t.Errorf("got final response %d with Link %q, want 200 without Link", resp.StatusCode, resp.Header.Get("Link"))
+	}
+
+	req, err = http.NewRequest(http.MethodPut, srv.URL, bytes.NewReader(make([]byte, 1<<20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Expect", "100-continue")
+	codes, _, resp = do(req)
+	// The 100 of the backend is not relayed on top of the one the proxy
+	// sends when it starts reading the body.
+	if !reflect.DeepEqual(codes, []int{http.StatusContinue}) {
+		t.Errorf("got 1xx responses %v, want a single 100", codes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d for the PUT, want 200", resp.StatusCode)
+	}
+}
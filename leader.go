@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	leaseName               = "tailscale-ingress-controller"
+	serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// podNamespace returns the namespace the controller runs in.
+func podNamespace() (string, error) {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	b, err := os.ReadFile(serviceAccountNamespace)
+	if err != nil {
+		return "", fmt.Errorf("failed to read namespace: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// runLeaderElection calls run once this replica holds the Lease, and returns
+// when ctx is done or the Lease was lost. Other replicas stand by until then.
+// Once ctx is done, beforeRelease is called and then the Lease is released so
+// that one of them takes over right away, without the hosts being served
+// twice.
+func runLeaderElection(ctx context.Context, client kubernetes.Interface, c *controller, run func(context.Context), beforeRelease func()) error {
+	ns, err := podNamespace()
+	if err != nil {
+		return err
+	}
+	id := os.Getenv("POD_NAME")
+	if id == "" {
+		if id, err = os.Hostname(); err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: ns},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+	c.standby.Store(true)
+	log.Printf("waiting to lead as %s", id)
+	// The elector releases the Lease as soon as its context is canceled, so
+	// it gets its own, canceled once the hosts are down.
+	electCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			beforeRelease()
+			cancel()
+		case <-electCtx.Done():
+		}
+	}()
+	leaderelection.RunOrDie(electCtx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Println("started leading")
+				c.standby.Store(false)
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				log.Println("stopped leading")
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					log.Printf("%s is leading", identity)
+				}
+			},
+		},
+	})
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func TestLeaseReleasedAfterShutdown(t *testing.T) {
+	t.Setenv("POD_NAMESPACE", "tailscale")
+	t.Setenv("POD_NAME", "replica-1")
+	client := fake.NewSimpleClientset()
+	c := newTestController(t, controllerConfig{})
+	holder := func() string {
+		l, err := client.CoordinationV1().Leases("tailscale").Get(context.Background(), leaseName, metav1.GetOptions{})
+		if err != nil || l.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *l.Spec.HolderIdentity
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leading := make(chan struct{})
+	var holderBeforeRelease string
+	done := make(chan error)
+	go func() {
+		done <- runLeaderElection(ctx, client, c, func(ctx context.Context) {
+			close(leading)
+			<-ctx.Done()
+		}, func() {
+			holderBeforeRelease = holder()
+		})
+	}()
+	select {
+	case <-leading:
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't start leading")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if holderBeforeRelease != "replica-1" {
+		t.Errorf("lease held by %q before release, want replica-1", holderBeforeRelease)
+	}
+	if h := holder(); h != "" {
+		t.Errorf("lease still held by %q after return", h)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBodySizeAnnotation              = "tailscale.com/max-body-size"
+	maxBodySizeByContentTypeAnnotation = "tailscale.com/max-body-size-by-content-type"
+	maxRequestHeadersAnnotation        = "tailscale.com/max-request-headers"
+	maxRequestHeaderBytesAnnotation    = "tailscale.com/max-request-header-bytes"
+)
+
+// contentTypeLimit caps the request body size for a media type, which may be a
+// wildcard such as image/* or */*.
+type contentTypeLimit struct {
+	contentType string
+	limit       int64
+}
+
+// parseSize parses a byte size with an optional k, m or g suffix, e.g. 10m.
+func parseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(v, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(v, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
+
+// parseContentTypeLimits parses a comma-separated list of type=size pairs,
+// e.g. "image/*=10m,application/json=1m". Invalid entries are logged and
+// skipped.
+func parseContentTypeLimits(v string) []contentTypeLimit {
+	var limits []contentTypeLimit
+	for _, entry := range strings.Split(v, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		contentType, size, ok := strings.Cut(entry, "=")
+		if !ok {
+			log.Printf("ignoring invalid content type limit %q", entry)
+			continue
+		}
+		limit, err := parseSize(size)
+		if err != nil {
+			log.Printf("ignoring invalid content type limit %q: %v", entry, err)
+			continue
+		}
+		limits = append(limits, contentTypeLimit{
+			contentType: strings.ToLower(strings.TrimSpace(contentType)),
+			limit:       limit,
+		})
+	}
+	return limits
+}
+
+// maxBodySize returns the limit of the max-body-size annotation, or -1 if it
+// is unset or invalid.
+func maxBodySize(annotations map[string]string) int64 {
+	v, ok := annotations[maxBodySizeAnnotation]
+	if !ok {
+		return -1
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		log.Printf("ignoring invalid %s annotation: %v", maxBodySizeAnnotation, err)
+		return -1
+	}
+	return n
+}
+
+// bodyLimit returns the limit for the given Content-Type header, preferring an
+// exact media type over a type wildcard over */*.
+func bodyLimit(limits []contentTypeLimit, contentType string) (int64, bool) {
+	if len(limits) == 0 {
+		return 0, false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+	typeWildcard := strings.SplitN(mediaType, "/", 2)[0] + "/*"
+	var best *contentTypeLimit
+	for i, l := range limits {
+		switch {
+		case l.contentType == mediaType:
+			return l.limit, true
+		case l.contentType == typeWildcard:
+			best = &limits[i]
+		case l.contentType == "*/*" && best == nil:
+			best = &limits[i]
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.limit, true
+}
+
+// limitBody caps the request body at limit bytes. It reports false after
+// responding with a 413 if the declared length already exceeds the limit.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) bool {
+	if r.ContentLength > limit {
+		http.Error(w, fmt.Sprintf("request body exceeds the limit of %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// headerLimits caps the number and total size of request headers. A zero
+// value disables the corresponding limit.
+type headerLimits struct {
+	count int
+	bytes int64
+}
+
+func headerLimitsFromEnv() (headerLimits, error) {
+	var l headerLimits
+	if v := os.Getenv("TIC_MAX_REQUEST_HEADERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid TIC_MAX_REQUEST_HEADERS %q", v)
+		}
+		l.count = n
+	}
+	if v := os.Getenv("TIC_MAX_REQUEST_HEADER_BYTES"); v != "" {
+		n, err := parseSize(v)
+		if err != nil {
+			return l, fmt.Errorf("invalid TIC_MAX_REQUEST_HEADER_BYTES: %w", err)
+		}
+		l.bytes = n
+	}
+	return l, nil
+}
+
+// withAnnotations returns a copy of l with any limits set in the ingress
+// annotations applied.
+func (l headerLimits) withAnnotations(annotations map[string]string) headerLimits {
+	if v, ok := annotations[maxRequestHeadersAnnotation]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("ignoring invalid %s annotation %q", maxRequestHeadersAnnotation, v)
+		} else {
+			l.count = n
+		}
+	}
+	if v, ok := annotations[maxRequestHeaderBytesAnnotation]; ok {
+		n, err := parseSize(v)
+		if err != nil {
+			log.Printf("ignoring invalid %s annotation %q: %v", maxRequestHeaderBytesAnnotation, v, err)
+		} else {
+			l.bytes = n
+		}
+	}
+	return l
+}
+
+// check responds with a 431 and reports false if the request headers exceed
+// the limits.
+func (l headerLimits) check(w http.ResponseWriter, r *http.Request) bool {
+	if l.count == 0 && l.bytes == 0 {
+		return true
+	}
+	var count int
+	var size int64
+	for k, vv := range r.Header {
+		count += len(vv)
+		for _, v := range vv {
+			// Account for the ": " separator and trailing CRLF.
+			size += int64(len(k) + len(v) + 4)
+		}
+	}
+	if l.count > 0 && count > l.count {
+		http.Error(w, fmt.Sprintf("request has more than %d headers", l.count), http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+	if l.bytes > 0 && size > l.bytes {
+		http.Error(w, fmt.Sprintf("request headers exceed %d bytes", l.bytes), http.StatusRequestHeaderFieldsTooLarge)
+		return false
+	}
+	return true
+}
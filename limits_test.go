@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{" 10k ", 10 << 10, false},
+		{"10K", 10 << 10, false},
+		{"1m", 1 << 20, false},
+		{"2g", 2 << 30, false},
+		{"8589934591g", 8589934591 << 30, false},
+		{"8589934592g", 0, true},
+		{"9223372036854775807", 9223372036854775807, false},
+		{"9223372036854775807k", 0, true},
+		{"9223372036854775808", 0, true},
+		{"-1", 0, true},
+		{"-1m", 0, true},
+		{"", 0, true},
+		{"m", 0, true},
+		{"10mb", 0, true},
+		{"1.5m", 0, true},
+	} {
+		got, err := parseSize(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSize(%q): got error %v, want error %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	limits := parseContentTypeLimits("image/*=10m, application/json=1k,invalid,text/plain=big,*/*=100")
+	if len(limits) != 3 {
+		t.Fatalf("got %d limits, want 3: %v", len(limits), limits)
+	}
+	for _, tt := range []struct {
+		contentType string
+		want        int64
+	}{
+		{"application/json", 1 << 10},
+		{"Application/JSON; charset=utf-8", 1 << 10},
+		{"image/png", 10 << 20},
+		{"text/plain", 100},
+		{"", 100},
+		{"not a media type", 100},
+	} {
+		got, ok := bodyLimit(limits, tt.contentType)
+		if !ok || got != tt.want {
+			t.Errorf("%q: got limit %d, %t, want %d", tt.contentType, got, ok, tt.want)
+		}
+	}
+	if _, ok := bodyLimit(limits[:2], "text/plain"); ok {
+		t.Error("got a limit for a content type without one")
+	}
+	if _, ok := bodyLimit(nil, "application/json"); ok {
+		t.Error("got a limit without limits")
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limitBody(w, r, 10) {
+			return
+		}
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name    string
+		body    io.Reader
+		chunked bool
+		want    int
+	}{
+		{"under the limit", strings.NewReader("0123456789"), false, http.StatusOK},
+		{"over the limit", strings.NewReader("0123456789a"), false, http.StatusRequestEntityTooLarge},
+		{"chunked under the limit", strings.NewReader("0123456789"), true, http.StatusOK},
+		{"chunked over the limit", strings.NewReader("0123456789a"), true, http.StatusRequestEntityTooLarge},
+	} {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, tt.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.chunked {
+			// An unknown length makes the client send the body chunked.
+			req.ContentLength = -1
+			req.Body = io.NopCloser(tt.body)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	header := http.Header{
+		"Accept":        {"*/*"},
+		"Cookie":        {"a=1", "b=2"},
+		"Authorization": {"Bearer token"},
+	}
+	// Each value counts its name, the value and 4 bytes of separators.
+	const size = 6 + 3 + 4 + 2*(6+3+4) + 13 + 12 + 4
+	for _, tt := range []struct {
+		limits headerLimits
+		want   bool
+	}{
+		{headerLimits{}, true},
+		{headerLimits{count: 4}, true},
+		{headerLimits{count: 3}, false},
+		{headerLimits{bytes: size}, true},
+		{headerLimits{bytes: size - 1}, false},
+		{headerLimits{count: 4, bytes: size - 1}, false},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = header
+		if got := tt.limits.check(w, r); got != tt.want {
+			t.Errorf("%+v: got %t, want %t", tt.limits, got, tt.want)
+		}
+		if !tt.want && w.Code != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("%+v: got status %d, want 431", tt.limits, w.Code)
+		}
+	}
+
+	l := headerLimits{count: 10, bytes: 1 << 10}.withAnnotations(map[string]string{
+		maxRequestHeadersAnnotation:     "20",
+		maxRequestHeaderBytesAnnotation: "invalid",
+	})
+	if l.count != 20 || l.bytes != 1<<10 {
+		t.Errorf("got limits %+v with annotations, want count 20 and 1024 bytes", l)
+	}
+
+	t.Setenv("TIC_MAX_REQUEST_HEADERS", "50")
+	t.Setenv("TIC_MAX_REQUEST_HEADER_BYTES", "16k")
+	if l, err := headerLimitsFromEnv(); err != nil || l.count != 50 || l.bytes != 16<<10 {
+		t.Errorf("got limits %+v, %v from the environment, want count 50 and 16384 bytes", l, err)
+	}
+	t.Setenv("TIC_MAX_REQUEST_HEADERS", "-1")
+	if _, err := headerLimitsFromEnv(); err == nil {
+		t.Error("got no error for a negative TIC_MAX_REQUEST_HEADERS")
+	}
+}
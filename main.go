@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"github.com/bep/debounce"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -12,17 +16,50 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type update struct {
-	ingresses []*v1.Ingress
+	ingresses      []*v1.Ingress
+	ingressClasses []*v1.IngressClass
+	services       []*corev1.Service
+	endpointSlices []*discoveryv1.EndpointSlice
 }
 
-func listen(ctx context.Context, client kubernetes.Interface, handleUpdate func(*update)) {
-	factory := informers.NewSharedInformerFactory(client, time.Minute)
+// listen calls handleUpdate with the current resources whenever they change in
+// a way that may affect the routes, at most once per cfg.reconcileDebounce.
+// Only cfg.watchNamespace is watched, or all namespaces if it is empty.
+// HTTPRoutes are also watched, with dyn, if the Gateway API is enabled.
+func listen(ctx context.Context, client kubernetes.Interface, dyn dynamic.Interface, cfg controllerConfig, handleUpdate func(*update)) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, time.Minute, informers.WithNamespace(cfg.watchNamespace))
+	if cfg.watchNamespace != "" {
+		log.Printf("watching namespace %s", cfg.watchNamespace)
+	} else {
+		log.Println("watching all namespaces")
+	}
 	ingressLister := factory.Networking().V1().Ingresses().Lister()
+	// Without IngressClasses, listClasses returns none.
+	listClasses := func() ([]*v1.IngressClass, error) { return nil, nil }
+	var ingressClassInformer cache.SharedIndexInformer
+	if canListIngressClasses(ctx, client) {
+		ingressClassInformer = factory.Networking().V1().IngressClasses().Informer()
+		lister := factory.Networking().V1().IngressClasses().Lister()
+		listClasses = func() ([]*v1.IngressClass, error) { return lister.List(labels.Everything()) }
+	}
+	serviceLister := factory.Core().V1().Services().Lister()
+	endpointSliceLister := factory.Discovery().V1().EndpointSlices().Lister()
+	// GatewayClasses are cluster-scoped, so they are watched in all
+	// namespaces.
+	var gatewayClassInformer, gatewayInformer, httpRouteInformer informers.GenericInformer
+	if cfg.gatewayAPI {
+		dynFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dyn, time.Minute, cfg.watchNamespace, nil)
+		gatewayClassInformer = dynamicinformer.NewDynamicSharedInformerFactory(dyn, time.Minute).ForResource(gatewayClassesResource)
+		gatewayInformer = dynFactory.ForResource(gatewaysResource)
+		httpRouteInformer = dynFactory.ForResource(httpRoutesResource)
+	}
 
 	onChange := func() {
 		ingresses, err := ingressLister.List(labels.Everything())
@@ -30,30 +67,154 @@ func listen(ctx context.Context, client kubernetes.Interface, handleUpdate func(
 			log.Println("failed to list ingresses: ", err)
 			return
 		}
-		handleUpdate(&update{ingresses})
+		ingressClasses, err := listClasses()
+		if err != nil {
+			log.Println("failed to list ingress classes: ", err)
+			return
+		}
+		services, err := serviceLister.List(labels.Everything())
+		if err != nil {
+			log.Println("failed to list services: ", err)
+			return
+		}
+		endpointSlices, err := endpointSliceLister.List(labels.Everything())
+		if err != nil {
+			log.Println("failed to list endpoint slices: ", err)
+			return
+		}
+		if cfg.gatewayAPI {
+			classes, err := gatewayClassInformer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Println("failed to list gateway classes: ", err)
+				return
+			}
+			gateways, err := gatewayInformer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Println("failed to list gateways: ", err)
+				return
+			}
+			routes, err := httpRouteInformer.Lister().List(labels.Everything())
+			if err != nil {
+				log.Println("failed to list http routes: ", err)
+				return
+			}
+			ingresses = append(ingresses, cfg.ingressesFromRoutes(classes, gateways, routes)...)
+		}
+		handleUpdate(&update{ingresses, ingressClasses, services, endpointSlices})
 	}
 
-	debounced := debounce.New(time.Second)
-	eventHandler := cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(any) { debounced(onChange) },
-		UpdateFunc: func(any, any) { debounced(onChange) },
-		DeleteFunc: func(any) { debounced(onChange) },
+	debounced := debounce.New(cfg.reconcileDebounce)
+	var synced atomic.Bool
+	// handler reconciles on events passing the filter, and skips those for
+	// objects that can't change the routes: ingresses of other classes, and
+	// services and endpoint slices of services none of our ingresses route to.
+	handler := func(filter func(obj any) bool) cache.ResourceEventHandler {
+		handle := func(pass bool) {
+			if !synced.Load() {
+				return
+			}
+			if !pass {
+				reconcileEventsTotal.WithLabelValues("skipped").Inc()
+				return
+			}
+			reconcileEventsTotal.WithLabelValues("triggered").Inc()
+			debounced(onChange)
+		}
+		return cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj any) { handle(filter(obj)) },
+			UpdateFunc: func(oldObj, newObj any) { handle(filter(oldObj) || filter(newObj)) },
+			DeleteFunc: func(obj any) {
+				if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = d.Obj
+				}
+				handle(filter(obj))
+			},
+		}
 	}
+	isOurs := func(ing *v1.Ingress) bool {
+		classes, err := listClasses()
+		if err != nil {
+			return true
+		}
+		return cfg.ourClasses(classes)[ingressClassName(ing)]
+	}
+	isRouted := func(namespace, service string) bool {
+		ingresses, err := ingressLister.Ingresses(namespace).List(labels.Everything())
+		if err != nil {
+			return true
+		}
+		for _, ing := range ingresses {
+			if isOurs(ing) && referencesService(ing, service) {
+				return true
+			}
+		}
+		if cfg.gatewayAPI {
+			routes, err := httpRouteInformer.Lister().ByNamespace(namespace).List(labels.Everything())
+			if err != nil {
+				return true
+			}
+			for _, r := range routes {
+				if routeReferencesService(r, service) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	ingressHandler := handler(func(obj any) bool {
+		ing, ok := obj.(*v1.Ingress)
+		return !ok || isOurs(ing)
+	})
+	serviceHandler := handler(func(obj any) bool {
+		svc, ok := obj.(*corev1.Service)
+		return !ok || isRouted(svc.Namespace, svc.Name)
+	})
+	endpointSliceHandler := handler(func(obj any) bool {
+		es, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok {
+			return true
+		}
+		service, ok := es.Labels[discoveryv1.LabelServiceName]
+		return !ok || isRouted(es.Namespace, service)
+	})
+
+	handlers := map[cache.SharedIndexInformer]cache.ResourceEventHandler{
+		factory.Networking().V1().Ingresses().Informer():     ingressHandler,
+		factory.Core().V1().Services().Informer():            serviceHandler,
+		factory.Discovery().V1().EndpointSlices().Informer(): endpointSliceHandler,
+	}
+	if ingressClassInformer != nil {
+		handlers[ingressClassInformer] = handler(func(any) bool { return true })
+	}
+	if cfg.gatewayAPI {
+		for _, i := range []informers.GenericInformer{gatewayClassInformer, gatewayInformer, httpRouteInformer} {
+			handlers[i.Informer()] = handler(func(any) bool { return true })
+		}
+	}
+	var hasSynced []cache.InformerSynced
+	for i, h := range handlers {
+		i.AddEventHandler(h)
+		hasSynced = append(hasSynced, i.HasSynced)
+		go i.Run(ctx.Done())
+	}
+	// Reconciling against partially filled caches would delete the hosts
+	// that weren't listed yet, so events are ignored until the initial
+	// lists are complete, after which everything is reconciled once.
+	if !cache.WaitForCacheSync(ctx.Done(), hasSynced...) {
+		return
+	}
+	log.Println("caches synced")
+	synced.Store(true)
+	onChange()
 
-	go func() {
-		i := factory.Networking().V1().Ingresses().Informer()
-		i.AddEventHandler(eventHandler)
-		i.Run(ctx.Done())
-	}()
-	go func() {
-		i := factory.Core().V1().Services().Informer()
-		i.AddEventHandler(eventHandler)
-		i.Run(ctx.Done())
-	}()
 	<-ctx.Done()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(runStatus(os.Args[2:]))
+	}
+
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		log.Fatal("failed to get kubernetes config:", err)
@@ -63,12 +224,41 @@ func main() {
 		log.Fatal("failed to create kubernetes client", err)
 	}
 
-	tsAuthKey := os.Getenv("TS_AUTHKEY")
-	if tsAuthKey == "" {
-		log.Fatal("missing TS_AUTHKEY")
+	cfg, err := configFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var dyn dynamic.Interface
+	if cfg.gatewayAPI {
+		if err := checkGatewayAPI(client.Discovery()); err != nil {
+			log.Fatal("ENABLE_GATEWAY_API is set: ", err)
+		}
+		if dyn, err = dynamic.NewForConfig(config); err != nil {
+			log.Fatal("failed to create dynamic kubernetes client", err)
+		}
 	}
 
-	c := newController(tsAuthKey)
+	c := newController(cfg, client)
+
+	if cfg.dryRun {
+		os.Exit(dryRun(client, dyn, c))
+	}
+	recorder, stopRecorder := newEventRecorder(client)
+	c.recorder = recorder
+	go c.checkAuthKey()
+
+	admin := newAdminServer(cfg.adminAddr, c)
+	go func() {
+		if err := admin.ListenAndServe(); err != nil {
+			log.Println("failed to serve admin endpoints: ", err)
+		}
+	}()
+	control := newControlServer(cfg.controlAddr, c)
+	go func() {
+		if err := control.ListenAndServe(); err != nil {
+			log.Println("failed to serve control endpoints: ", err)
+		}
+	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s := make(chan os.Signal, 1)
@@ -77,7 +267,56 @@ func main() {
 		<-s
 		log.Println("shutting down")
 		cancel()
-		os.Exit(0)
 	}()
-	listen(ctx, client, c.update)
+	run := func(ctx context.Context) {
+		listen(ctx, client, dyn, cfg, c.update)
+	}
+	var shutdownOnce sync.Once
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+			defer shutdownCancel()
+			c.shutdown(shutdownCtx)
+		})
+	}
+	if cfg.leaderElection {
+		if err := runLeaderElection(ctx, client, c, run, shutdown); err != nil {
+			log.Fatal("failed to run leader election: ", err)
+		}
+	} else {
+		run(ctx)
+	}
+
+	shutdown()
+	stopRecorder()
+	// Leader election only returns early if the lease was lost, in which
+	// case the replica restarts to stand by again.
+	if ctx.Err() == nil {
+		os.Exit(1)
+	}
+}
+
+// dryRun applies the first update without starting nodes and logs the
+// resulting routes and errors, returning the exit code: 1 if there were
+// errors.
+func dryRun(client kubernetes.Interface, dyn dynamic.Interface, c *controller) int {
+	log.Println("dry run: no node will be started")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	listen(ctx, client, dyn, c.controllerConfig, func(u *update) {
+		c.update(u)
+		cancel()
+	})
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.routes == nil {
+		log.Println("dry run timed out waiting for resources")
+		return 1
+	}
+	logRoutes(c.routes)
+	if len(c.errors.recent()) > 0 {
+		log.Println("dry run found errors")
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tic_requests_total",
+		Help: "Requests received by the hosts, by host, backend and response status code.",
+	}, []string{"host", "backend", "code"})
+	proxyErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tic_proxy_errors_total",
+		Help: "Requests that could not be proxied, by host and reason.",
+	}, []string{"host", "reason"})
+	retriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tic_proxy_retries_total",
+		Help: "Requests sent to a backend again after failing to reach it.",
+	})
+	retriesThrottledTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tic_proxy_retries_throttled_total",
+		Help: "Failed requests not retried as their retry budget was exhausted.",
+	})
+	retryBudgetGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tic_proxy_retry_budget_tokens",
+		Help: "Tokens left in the retry budgets, by ingress; retries are allowed above half of the capacity of 10.",
+	}, []string{"ingress"})
+	reconcileErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tic_reconcile_errors_total",
+		Help: "Reconcile errors, by kind.",
+	}, []string{"kind"})
+	reconcileEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tic_reconcile_events_total",
+		Help: "Watch events, by whether they triggered a reconcile or were skipped as irrelevant.",
+	}, []string{"result"})
+	circuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tic_circuit_breaker_state",
+		Help: "State of the circuit breakers, by ingress and backend: 0 closed, 1 open, 2 half-open.",
+	}, []string{"ingress", "backend"})
+	hostsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tic_hosts",
+		Help: "HTTP hosts currently served.",
+	})
+	nodesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tic_nodes",
+		Help: "Tailnet nodes, by state.",
+	}, []string{"state"})
+)
+
+// unknownHost labels the metrics of requests for hosts that aren't served, so
+// that clients can't create a series for every Host header they send.
+const unknownHost = "unknown"
+
+// hostLabel returns host as a metric label if it is served, and unknownHost
+// otherwise.
+func (c *controller) hostLabel(host string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.hosts[host]; !ok {
+		return unknownHost
+	}
+	return host
+}
+
+// observeRequest counts a request to host answered with the given status code.
+// backend is empty if the request didn't match a path.
+func observeRequest(host, backend string, code int) {
+	requestsTotal.WithLabelValues(host, backend, strconv.Itoa(code)).Inc()
+}
+
+// observeProxyError counts a request to host that could not be proxied.
+func observeProxyError(host, reason string) {
+	proxyErrorsTotal.WithLabelValues(host, reason).Inc()
+}
+
+// updateHostMetrics sets the host and node gauges from the current state. c.mu
+// must be held.
+func (c *controller) updateHostMetrics() {
+	hostsGauge.Set(float64(len(c.hosts)))
+	var starting, running, failed int
+	for n := range c.nodes {
+		switch {
+		case n.failed:
+			failed++
+		case n.running:
+			running++
+		default:
+			starting++
+		}
+	}
+	nodesGauge.WithLabelValues("starting").Set(float64(starting))
+	nodesGauge.WithLabelValues("running").Set(float64(running))
+	nodesGauge.WithLabelValues("failed").Set(float64(failed))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/api/networking/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnknownHostLabel(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com", ingressPath("/api", v1.PathTypePrefix, "web"))
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c.mu.RLock()
+	n := c.hosts["app.example.com"].node
+	c.mu.RUnlock()
+	handler := c.newHandler(n, fakeWhoIs{})
+
+	get := func(host, path string) {
+		r, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	// Requests for a served host, and for any other, before and while
+	// draining, create the series that may exist.
+	warmUp := func() {
+		get("app.example.com", "/api")
+		get("app.example.com", "/other")
+		get("random.example.com", "/")
+	}
+	warmUp()
+	c.draining.Store(true)
+	warmUp()
+	c.draining.Store(false)
+	requests, errs := testutil.CollectAndCount(requestsTotal), testutil.CollectAndCount(proxyErrorsTotal)
+	for i := 0; i < 100; i++ {
+		get(fmt.Sprintf("host-%d.example.com", i), "/")
+	}
+	c.draining.Store(true)
+	for i := 0; i < 100; i++ {
+		get(fmt.Sprintf("draining-%d.example.com", i), "/")
+	}
+	if got := testutil.CollectAndCount(requestsTotal); got != requests {
+		t.Errorf("got %d request series after requests for arbitrary hosts, want %d", got, requests)
+	}
+	if got := testutil.CollectAndCount(proxyErrorsTotal); got != errs {
+		t.Errorf("got %d proxy error series after requests for arbitrary hosts, want %d", got, errs)
+	}
+	if got := testutil.ToFloat64(proxyErrorsTotal.WithLabelValues(unknownHost, "not_found")); got < 101 {
+		t.Errorf("got %v not_found errors for unknown hosts, want at least 101", got)
+	}
+	if got := testutil.ToFloat64(proxyErrorsTotal.WithLabelValues("app.example.com", "not_found")); got < 1 {
+		t.Errorf("got %v not_found errors for app.example.com, want at least 1", got)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+	"time"
+)
+
+// node is a tailnet node serving one host, or every host when running with a
+// shared node.
+type node struct {
+	tsServer   *tsnet.Server
+	httpServer *http.Server
+	// redirectServer redirects HTTP requests to HTTPS for nodes using TLS.
+	redirectServer *http.Server
+	started        bool
+	// starting is set while startNode brings the node up without c.mu held.
+	starting bool
+	// done is closed once the node is stopped after being closed.
+	done chan struct{}
+	// tsStarted is set once tsServer.Start succeeded, running once the node
+	// reached the Running state and failed if it didn't do so in time.
+	tsStarted, running, failed bool
+	closed                     bool
+	useTls                     bool
+	timeouts                   timeouts
+	// address is the MagicDNS name of the node and ips its tailnet IPs once
+	// it is running.
+	address string
+	ips     []string
+	// tags are the ACL tags applied to the node once it is running.
+	tags []string
+	// extraPorts are the ports the node listens on besides 443 or 80.
+	extraPorts []int
+	// deviceID is the ID of the node in the Tailscale API once it is running.
+	deviceID string
+
+	// loginError is the last error logging the node in, as logged by its
+	// control client.
+	loginMu    sync.Mutex
+	loginError string
+}
+
+// logf logs the messages of the tsnet server of n, recording its login
+// errors. The health state tsnet keeps them in is shared by every node of the
+// process.
+func (n *node) logf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Print(msg)
+	const prefix = "[v1] TryLogin: "
+	if i := strings.Index(msg, prefix); i >= 0 {
+		n.loginMu.Lock()
+		n.loginError = msg[i+len(prefix):]
+		n.loginMu.Unlock()
+	}
+}
+
+func (n *node) lastLoginError() string {
+	n.loginMu.Lock()
+	defer n.loginMu.Unlock()
+	return n.loginError
+}
+
+// newNode returns a node with the given tailnet hostname, keeping its state in
+// a directory named after it. c.mu must be held for writing.
+func (c *controller) newNode(hostname string, useTls bool, t timeouts, tags []string, extraPorts []int) (*node, error) {
+	stateDir := c.stateDir
+	if stateDir == "" {
+		confDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user config dir: %w", err)
+		}
+		stateDir = filepath.Join(confDir, "ts")
+	}
+	dir := filepath.Join(stateDir, hostname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create config dir: %w", err)
+	}
+	n := &node{
+		tsServer: &tsnet.Server{
+			Dir: dir,
+			//Store:     nil, TODO: store in k8s
+			Hostname:  hostname,
+			Ephemeral: c.ephemeral,
+			AuthKey:   c.tsAuthKey,
+		},
+		done:       make(chan struct{}),
+		useTls:     useTls,
+		timeouts:   t,
+		tags:       tags,
+		extraPorts: extraPorts,
+	}
+	n.tsServer.Logf = n.logf
+	c.nodes[n] = struct{}{}
+	return n, nil
+}
+
+const extraPortsAnnotation = "tailscale.com/extra-ports"
+
+// parsePorts parses a comma-separated list of extra ports, such as
+// "8080,8443", sorted and without the standard ports.
+func parsePorts(v string) []int {
+	var ports []int
+	for _, e := range strings.Split(v, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		p, err := strconv.Atoi(e)
+		if err != nil || p < 1 || p > 65535 || p == 80 || p == 443 {
+			log.Printf("ignoring invalid port %q in %s annotation", e, extraPortsAnnotation)
+			continue
+		}
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	unique := ports[:0]
+	for i, p := range ports {
+		if i == 0 || p != ports[i-1] {
+			unique = append(unique, p)
+		}
+	}
+	return unique
+}
+
+func equalPorts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const hostnameAnnotation = "tailscale.com/hostname"
+
+// nodeHostname returns the tailnet hostname of the node for a host: the
+// hostname annotation, if the ingress has a single host, or the host itself.
+func nodeHostname(ingress *v1.Ingress, host string) string {
+	name, ok := ingress.Annotations[hostnameAnnotation]
+	if !ok || name == "" {
+		return host
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Host != "" && rule.Host != host {
+			log.Printf("ignoring %s annotation of ingress %s/%s with several hosts", hostnameAnnotation, ingress.Namespace, ingress.Name)
+			return host
+		}
+	}
+	return name
+}
+
+func (n *node) hostname() string {
+	return n.tsServer.Hostname
+}
+
+// startNode brings the node up and serves the hosts routed to it. It must be
+// called without c.mu held; a node closed meanwhile is stopped once it is up.
+func (c *controller) startNode(n *node) error {
+	c.mu.Lock()
+	if n.closed || n.started || n.starting {
+		c.mu.Unlock()
+		return nil
+	}
+	n.starting = true
+	tsStarted, tags := n.tsStarted, n.tags
+	// A closed node with the same hostname, such as the one this node
+	// replaces, must be down first, as they share their state directory.
+	var previous []chan struct{}
+	for o := range c.stopping {
+		if strings.EqualFold(o.hostname(), n.hostname()) {
+			previous = append(previous, o.done)
+		}
+	}
+	c.mu.Unlock()
+	for _, done := range previous {
+		<-done
+	}
+
+	httpServer, redirectServer, lc, err := c.bringUp(n, tsStarted, tags)
+
+	c.mu.Lock()
+	n.starting = false
+	if err == nil {
+		httpServer.SetKeepAlivesEnabled(!c.draining.Load())
+		n.httpServer = httpServer
+		n.redirectServer = redirectServer
+		n.started = true
+	}
+	closed := n.closed
+	if closed {
+		c.stopping[n] = true
+	} else if err == nil {
+		go c.watchProvisioning(n, lc)
+	}
+	c.mu.Unlock()
+	if closed {
+		ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+		defer cancel()
+		c.stopNode(ctx, n)
+		return nil
+	}
+	return err
+}
+
+// bringUp starts the tsnet server of n unless tsStarted, minting an auth key
+// with the given tags if using OAuth, and serves its hosts. c.mu must not be
+// held.
+func (c *controller) bringUp(n *node, tsStarted bool, tags []string) (*http.Server, *http.Server, *tailscale.LocalClient, error) {
+	if !tsStarted {
+		if c.oauthClientID != "" {
+			if len(tags) == 0 {
+				tags = c.oauthTags
+			}
+			key, err := c.createAuthKey(tags)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			n.tsServer.AuthKey = key
+		}
+		if err := n.tsServer.Start(); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to start ts server: %w", err)
+		}
+		c.mu.Lock()
+		n.tsStarted = true
+		c.mu.Unlock()
+	}
+
+	port := 80
+	if n.useTls {
+		port = 443
+	}
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	for _, p := range append([]int{port}, n.extraPorts...) {
+		ln, err := n.tsServer.Listen("tcp", fmt.Sprintf(":%d", p))
+		if err != nil {
+			closeAll()
+			return nil, nil, nil, fmt.Errorf("failed to listen on port %d: %w", p, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	lc, err := n.tsServer.LocalClient()
+	if err != nil {
+		closeAll()
+		return nil, nil, nil, fmt.Errorf("failed to get local client: %w", err)
+	}
+	if n.useTls {
+		for i, ln := range listeners {
+			listeners[i] = tls.NewListener(ln, &tls.Config{
+				GetCertificate: lc.GetCertificate,
+			})
+		}
+	}
+
+	srv := &http.Server{Handler: withAccessLog(c.accessLog, c.newHandler(n, lc))}
+	n.timeouts.applyToServer(srv)
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				c.recordError(errorKindNode, n.hostname(), "failed to serve: %v", err)
+			}
+		}(ln)
+	}
+	var redirect *http.Server
+	if n.useTls {
+		if redirect, err = c.startRedirect(n); err != nil {
+			c.recordError(errorKindNode, n.hostname(), "%v", err)
+		}
+	}
+	return srv, redirect, lc, nil
+}
+
+// startRedirect serves redirects from HTTP to HTTPS on port 80 of a node using
+// TLS.
+func (c *controller) startRedirect(n *node) (*http.Server, error) {
+	ln, err := n.tsServer.Listen("tcp", ":80")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for redirects: %w", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(redirectToHTTPS)}
+	n.timeouts.applyToServer(srv)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.recordError(errorKindNode, n.hostname(), "failed to serve redirects: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// closeNode removes a node from the controller. It is stopped by stopNode
+// once c.mu is released, or by startNode if it is still starting; until then
+// it is kept in c.stopping. c.mu must be held for writing.
+func (c *controller) closeNode(n *node) {
+	n.closed = true
+	delete(c.nodes, n)
+	if c.sharedNode == n {
+		c.sharedNode = nil
+	}
+	c.stopping[n] = false
+}
+
+// closedNodes returns the nodes closed since the last call, except those still
+// starting, for the caller to stop. c.mu must be held for writing.
+func (c *controller) closedNodes() []*node {
+	var closed []*node
+	for n, scheduled := range c.stopping {
+		if !scheduled && !n.starting {
+			c.stopping[n] = true
+			closed = append(closed, n)
+		}
+	}
+	return closed
+}
+
+// stopNode lets the requests in flight on a closed node complete until ctx is
+// done, logs it out if it is ephemeral and running, and shuts it down. It must
+// be called without c.mu held, as handlers need it to finish their requests.
+func (c *controller) stopNode(ctx context.Context, n *node) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.stopping, n)
+		c.mu.Unlock()
+		close(n.done)
+	}()
+	c.mu.RLock()
+	servers := []*http.Server{n.httpServer, n.redirectServer}
+	tsStarted, running := n.tsStarted, n.running
+	c.mu.RUnlock()
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			c.recordError(errorKindNode, n.hostname(), "failed to drain http server: %v", err)
+			srv.Close()
+		}
+	}
+	// tsnet.Server.Close must not be called unless Start succeeded.
+	if tsStarted {
+		// Running ephemeral nodes would otherwise linger on the tailnet until
+		// they expire; persistent ones are kept for their state to be reused.
+		if c.ephemeral && running {
+			c.logoutNode(ctx, n)
+		}
+		if err := n.tsServer.Close(); err != nil {
+			c.recordError(errorKindNode, n.hostname(), "failed to close ts server: %v", err)
+		}
+	}
+}
+
+// settingsChange returns which of the settings that can only be changed by
+// recreating n differ from the given ones, or "" if n can serve them as is.
+func (n *node) settingsChange(hostname string, useTls bool, t timeouts, extraPorts []int) string {
+	switch {
+	case n.hostname() != hostname:
+		return "hostname"
+	case n.useTls != useTls:
+		return "TLS setting"
+	case n.timeouts != t:
+		return "timeouts"
+	case !equalPorts(n.extraPorts, extraPorts):
+		return "extra ports"
+	}
+	return ""
+}
+
+// setTags changes the ACL tags of n, applying them right away if it is
+// running. c.mu must be held for writing.
+func (c *controller) setTags(n *node, tags []string) {
+	if equalTags(n.tags, tags) {
+		return
+	}
+	n.tags = tags
+	if n.running && n.deviceID != "" {
+		log.Printf("updating tags of node %s to %v", n.hostname(), tags)
+		go c.applyTags(n.hostname(), n.deviceID, tags)
+	}
+}
+
+// logoutNode logs n out, which removes an ephemeral node from the tailnet
+// right away, giving up after 5 seconds or once ctx is done.
+func (c *controller) logoutNode(ctx context.Context, n *node) {
+	lc, err := n.tsServer.LocalClient()
+	if err != nil {
+		c.recordError(errorKindNode, n.hostname(), "failed to get local client: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := lc.Logout(ctx); err != nil {
+		c.recordError(errorKindNode, n.hostname(), "failed to log out: %v", err)
+	}
+}
+
+// restartNode replaces a node by a new one with the same settings, moving the
+// hosts it serves over. c.mu must be held for writing.
+func (c *controller) restartNode(old *node) (*node, error) {
+	log.Printf("restarting node %s", old.hostname())
+	n, err := c.newNode(old.hostname(), old.useTls, old.timeouts, old.tags, old.extraPorts)
+	if err != nil {
+		return nil, err
+	}
+	shared := c.sharedNode == old
+	c.closeNode(old)
+	for _, h := range c.hosts {
+		if h.node == old {
+			h.node = n
+		}
+	}
+	if shared {
+		c.sharedNode = n
+	}
+	return n, nil
+}
+
+// watchProvisioning marks a node as failed if it doesn't reach the Running
+// state within the provisioning timeout, so that the next update tears it
+// down and tries again.
+func (c *controller) watchProvisioning(n *node, lc statusClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.provisionTimeout)
+	defer cancel()
+	st, err := waitRunning(ctx, lc, n.lastLoginError)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n.closed {
+		return
+	}
+	if errors.Is(err, errAuthKeyRejected) {
+		c.recordError(errorKindAuth, n.hostname(), "%v; check that TS_AUTHKEY is valid, not expired and reusable if several nodes are used", err)
+		c.authError = err.Error()
+		c.nodeEvent(n, corev1.EventTypeWarning, "NodeFailed", "Node %s failed to log in: %v", n.hostname(), err)
+		n.failed = true
+		c.updateHostMetrics()
+		return
+	}
+	if err != nil {
+		c.recordError(errorKindNode, n.hostname(), "node did not come up within %s: %v", c.provisionTimeout, err)
+		c.nodeEvent(n, corev1.EventTypeWarning, "NodeFailed", "Node %s did not come up within %s", n.hostname(), c.provisionTimeout)
+		n.failed = true
+		c.updateHostMetrics()
+		return
+	}
+	log.Printf("node %s is running", n.hostname())
+	n.running = true
+	c.authError = ""
+	if st.Self != nil {
+		n.address = strings.TrimSuffix(st.Self.DNSName, ".")
+		for _, ip := range st.TailscaleIPs {
+			n.ips = append(n.ips, ip.String())
+		}
+		n.deviceID = string(st.Self.ID)
+		go c.applyTags(n.hostname(), n.deviceID, n.tags)
+	}
+	c.nodeEvent(n, corev1.EventTypeNormal, "NodeRunning", "Node %s is running as %s", n.hostname(), n.address)
+	c.updateHostMetrics()
+	c.syncStatus()
+}
+
+// statusClient reports the state of a node, as its LocalClient does.
+type statusClient interface {
+	StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// errAuthKeyRejected is returned by waitRunning when the control server
+// refused the auth key, which retrying won't fix.
+var errAuthKeyRejected = errors.New("auth key rejected")
+
+// waitRunning polls the state of a node until it is Running or ctx is done,
+// and returns the status of the running node. loginError returns the last
+// login error of the node.
+func waitRunning(ctx context.Context, lc statusClient, loginError func() string) (*ipnstate.Status, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	state := "unknown"
+	for {
+		st, err := lc.StatusWithoutPeers(ctx)
+		if err == nil {
+			if st.BackendState == ipn.Running.String() {
+				return st, nil
+			}
+			state = st.BackendState
+			if state == ipn.NeedsLogin.String() {
+				if msg := loginError(); keyRejection(msg) {
+					return nil, fmt.Errorf("%w: %s", errAuthKeyRejected, msg)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("node is in state %s: %w", state, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// keyRejection reports whether a login error means that the control server
+// refused the auth key, e.g. because it is invalid or expired, rather than
+// that it couldn't be reached.
+func keyRejection(msg string) bool {
+	switch {
+	case strings.HasPrefix(msg, "register request: http 4"):
+		return true
+	case strings.HasPrefix(msg, "register request: "),
+		strings.HasPrefix(msg, "fetch control key"),
+		strings.HasPrefix(msg, "getNoiseClient: "):
+		return false
+	}
+	// Other refusals are the error message of the control server.
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "key") && (strings.Contains(msg, "invalid") || strings.Contains(msg, "expired") || strings.Contains(msg, "not valid"))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"k8s.io/api/networking/v1"
+	"k8s.io/client-go/tools/record"
+	"net/netip"
+	"reflect"
+	"strings"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"testing"
+	"time"
+)
+
+func TestKeyRejection(t *testing.T) {
+	for _, tt := range []struct {
+		msg  string
+		want bool
+	}{
+		{"", false},
+		{"register request: http 401: invalid key: unable to validate API key", true},
+		{"register request: http 403: node not authorized", true},
+		{"register request: http 500: internal error", false},
+		{"register request: Post \"https://controlplane.tailscale.com/machine/register\": dial tcp: i/o timeout", false},
+		{"register request: unexpected EOF", false},
+		{"fetch control key: Get \"https://controlplane.tailscale.com/key?v=40\": dial tcp: lookup controlplane.tailscale.com: no such host", false},
+		{"fetch control key: 502", false},
+		{"getNoiseClient: dial tcp 127.0.0.1:443: connect: connection refused", false},
+		{"invalid key: API key k1234 not valid", true},
+		{"invalid key: API key expired", true},
+		{"context deadline exceeded", false},
+	} {
+		if got := keyRejection(tt.msg); got != tt.want {
+			t.Errorf("keyRejection(%q) = %t, want %t", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestNodeLoginError(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	a, err := c.newNode("a", false, timeouts{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.newNode("b", false, timeouts{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The control client logs through the tsnet server of its node.
+	a.tsServer.Logf("control: [v1] %s: %v", "TryLogin", errors.New("invalid key: API key expired"))
+	b.tsServer.Logf("control: [v1] %s: %v", "TryLogout", errors.New("not logged in"))
+	if got := a.lastLoginError(); got != "invalid key: API key expired" {
+		t.Errorf("got login error %q for node a", got)
+	}
+	if got := b.lastLoginError(); got != "" {
+		t.Errorf("got login error %q for node b, want none", got)
+	}
+}
+
+// fakeStatus reports a node in a fixed state.
+type fakeStatus struct {
+	st *ipnstate.Status
+}
+
+func (f fakeStatus) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	return f.st, nil
+}
+
+func TestWatchProvisioning(t *testing.T) {
+	running := &ipnstate.Status{
+		BackendState: "Running",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+		Self:         &ipnstate.PeerStatus{ID: tailcfg.StableNodeID("n1"), DNSName: "app.tailnet.ts.net."},
+	}
+	for _, tt := range []struct {
+		name       string
+		st         *ipnstate.Status
+		loginError string
+		wantKind   string
+		wantEvent  string
+		problems   []string
+	}{
+		{"running", running, "", "", "Normal NodeRunning", nil},
+		{"timeout", &ipnstate.Status{BackendState: "Starting"}, "", errorKindNode, "Warning NodeFailed", []string{"node app.example.com failed to come up"}},
+		{"login unreachable", &ipnstate.Status{BackendState: "NeedsLogin"}, "fetch control key: 502", errorKindNode, "Warning NodeFailed", []string{"node app.example.com failed to come up"}},
+		{"key rejected", &ipnstate.Status{BackendState: "NeedsLogin"}, "invalid key: API key expired", errorKindAuth, "Warning NodeFailed", []string{"auth key rejected: invalid key: API key expired"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{provisionTimeout: 50 * time.Millisecond})
+			recorder := record.NewFakeRecorder(10)
+			c.recorder = recorder
+			c.update(&update{ingresses: []*v1.Ingress{testIngress("app", "app.example.com")}})
+			c.mu.RLock()
+			n := c.hosts["app.example.com"].node
+			c.mu.RUnlock()
+			n.started = true
+			if tt.loginError != "" {
+				n.tsServer.Logf("control: [v1] TryLogin: %s", tt.loginError)
+			}
+
+			c.watchProvisioning(n, fakeStatus{tt.st})
+
+			c.mu.RLock()
+			failed, isRunning, address := n.failed, n.running, n.address
+			c.mu.RUnlock()
+			if failed != (tt.wantKind != "") || isRunning != (tt.wantKind == "") {
+				t.Errorf("got failed %t and running %t", failed, isRunning)
+			}
+			if isRunning && address != "app.tailnet.ts.net" {
+				t.Errorf("got address %q, want app.tailnet.ts.net", address)
+			}
+			var kinds []string
+			for _, e := range c.errors.recent() {
+				if e.Host == n.hostname() {
+					kinds = append(kinds, e.Kind)
+				}
+			}
+			if tt.wantKind == "" && len(kinds) != 0 || tt.wantKind != "" && !reflect.DeepEqual(kinds, []string{tt.wantKind}) {
+				t.Errorf("got errors of kinds %v, want %q", kinds, tt.wantKind)
+			}
+			select {
+			case e := <-recorder.Events:
+				if !strings.HasPrefix(e, tt.wantEvent) {
+					t.Errorf("got event %q, want %s", e, tt.wantEvent)
+				}
+			default:
+				t.Errorf("got no event, want %s", tt.wantEvent)
+			}
+			if got := c.readinessProblems(); !reflect.DeepEqual(got, tt.problems) {
+				t.Errorf("got readiness problems %q, want %q", got, tt.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2/clientcredentials"
+	"io"
+	"net/http"
+	"net/url"
+	"tailscale.com/client/tailscale"
+	"time"
+)
+
+const apiBaseURL = "https://api.tailscale.com"
+
+// newOAuthAPIClient returns a client for the Tailscale API authenticating with
+// access tokens of an OAuth client, which are refreshed as they expire.
+func newOAuthAPIClient(clientID, clientSecret, tailnet string) *tailscale.Client {
+	credentials := clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     apiBaseURL + "/api/v2/oauth/token",
+	}
+	tailscale.I_Acknowledge_This_API_Is_Unstable = true
+	api := tailscale.NewClient(tailnet, nil)
+	api.HTTPClient = credentials.Client(context.Background())
+	return api
+}
+
+// apiBaseURL returns the address of the Tailscale API the API client uses.
+func (c *controller) apiBaseURL() string {
+	if c.api.BaseURL != "" {
+		return c.api.BaseURL
+	}
+	return apiBaseURL
+}
+
+// createAuthKey creates a single-use, pre-authorized auth key for a node with
+// the given tags through the OAuth client.
+func (c *controller) createAuthKey(tags []string) (string, error) {
+	var req struct {
+		Capabilities struct {
+			Devices struct {
+				Create struct {
+					Reusable      bool     `json:"reusable"`
+					Ephemeral     bool     `json:"ephemeral"`
+					Preauthorized bool     `json:"preauthorized"`
+					Tags          []string `json:"tags"`
+				} `json:"create"`
+			} `json:"devices"`
+		} `json:"capabilities"`
+		ExpirySeconds int `json:"expirySeconds"`
+	}
+	create := &req.Capabilities.Devices.Create
+	create.Ephemeral = c.ephemeral
+	create.Preauthorized = true
+	create.Tags = tags
+	// The key is used right away, so it needn't stay valid for long.
+	req.ExpirySeconds = int(time.Hour.Seconds())
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	u := fmt.Sprintf("%s/api/v2/tailnet/%s/keys", c.apiBaseURL(), url.PathEscape(c.tailnet))
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := c.api.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to create auth key: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("failed to create auth key: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var key struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return "", fmt.Errorf("failed to decode auth key: %w", err)
+	}
+	return key.Key, nil
+}
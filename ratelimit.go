@@ -0,0 +1,103 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	rateLimitAnnotation      = "tailscale.com/rate-limit"
+	rateLimitBurstAnnotation = "tailscale.com/rate-limit-burst"
+)
+
+// maxRateLimitKeys bounds the number of clients tracked by a rateLimiter,
+// which starts over once it is reached.
+const maxRateLimitKeys = 10000
+
+// rateLimiter keeps a token bucket per host and client for the paths of an
+// Ingress. It is kept across updates as long as its limit and burst stay the
+// same; annotation changes don't bump the Ingress generation.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// allow reports whether a request from the client identified by key to host
+// is within the limit.
+func (l *rateLimiter) allow(host, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	k := host + " " + key
+	lim, ok := l.limiters[k]
+	if !ok {
+		if len(l.limiters) >= maxRateLimitKeys {
+			l.limiters = make(map[string]*rate.Limiter)
+		}
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[k] = lim
+	}
+	return lim.Allow()
+}
+
+// rateLimiter returns the rate limiter for the paths of an Ingress, or nil if
+// it has none, reusing the one of the previous update unless its limit or
+// burst changed. The limiters in use are added to next. c.mu must be held for
+// writing.
+func (c *controller) rateLimiter(ingress *v1.Ingress, next map[types.UID]*rateLimiter) *rateLimiter {
+	v, ok := ingress.Annotations[rateLimitAnnotation]
+	if !ok {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		log.Printf("ignoring invalid %s annotation %q", rateLimitAnnotation, v)
+		return nil
+	}
+	burst := int(rps)
+	if burst < 1 {
+		burst = 1
+	}
+	if v, ok := ingress.Annotations[rateLimitBurstAnnotation]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Printf("ignoring invalid %s annotation %q", rateLimitBurstAnnotation, v)
+		} else {
+			burst = n
+		}
+	}
+	l, ok := c.rateLimiters[ingress.UID]
+	if !ok || l.limit != rate.Limit(rps) || l.burst != burst {
+		l = &rateLimiter{
+			limit:    rate.Limit(rps),
+			burst:    burst,
+			limiters: make(map[string]*rate.Limiter),
+		}
+	}
+	next[ingress.UID] = l
+	return l
+}
+
+// clientKey identifies the source of a request: the tailnet user, or the
+// device for tagged devices, which share a user. Without an identity it falls
+// back to the remote IP.
+func clientKey(who *apitype.WhoIsResponse, remoteAddr string) string {
+	if who != nil && who.Node != nil && len(who.Node.Tags) > 0 {
+		return "node:" + who.Node.Name
+	}
+	if who != nil && who.UserProfile != nil {
+		return "user:" + who.UserProfile.LoginName
+	}
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return "ip:" + ip
+	}
+	return "ip:" + remoteAddr
+}
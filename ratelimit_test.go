@@ -0,0 +1,47 @@
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+func TestRateLimiterReuse(t *testing.T) {
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com")
+	limiter := func(rps, burst string) *rateLimiter {
+		ing.Annotations = map[string]string{rateLimitAnnotation: rps}
+		if burst != "" {
+			ing.Annotations[rateLimitBurstAnnotation] = burst
+		}
+		next := make(map[types.UID]*rateLimiter)
+		l := c.rateLimiter(ing, next)
+		c.rateLimiters = next
+		return l
+	}
+
+	l := limiter("1", "2")
+	if !l.allow("app.example.com", "user:alice") || !l.allow("app.example.com", "user:alice") {
+		t.Fatal("requests within the burst were limited")
+	}
+	if l.allow("app.example.com", "user:alice") {
+		t.Error("request beyond the burst was allowed")
+	}
+	if !l.allow("app.example.com", "user:bob") {
+		t.Error("request of another client was limited")
+	}
+
+	if got := limiter("1", "2"); got != l {
+		t.Error("limiter with the same limit and burst wasn't reused")
+	}
+	// Annotation changes don't bump the generation.
+	if got := limiter("1", "5"); got == l {
+		t.Error("limiter was reused after the burst changed")
+	}
+	l = limiter("1", "5")
+	if got := limiter("10", "5"); got == l {
+		t.Error("limiter was reused after the limit changed")
+	}
+	if got := limiter("0", ""); got != nil {
+		t.Error("got a limiter for an invalid limit")
+	}
+}
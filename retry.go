@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	proxyMaxRetriesAnnotation     = "tailscale.com/proxy-max-retries"
+	proxyRetryBaseDelayAnnotation = "tailscale.com/proxy-retry-base-delay"
+	proxyRetryBudgetAnnotation    = "tailscale.com/proxy-retry-budget"
+)
+
+// retryBudgetTokens is the capacity of a retry budget. Retries are allowed
+// while more than half of it is left.
+const retryBudgetTokens = 10
+
+// retryBudget throttles the retries of the requests of an Ingress when many of
+// them fail, so that retries don't pile onto a struggling backend, as gRPC's
+// retry throttling does: each failed attempt takes a token and each success
+// gives back ratio tokens. It is kept across updates as long as its ratio
+// stays the same.
+type retryBudget struct {
+	ratio   float64
+	ingress string
+
+	mu     sync.Mutex
+	tokens float64
+}
+
+// done records the outcome of an attempt and reports, for a failed one,
+// whether the budget allows retrying it.
+func (b *retryBudget) done(ok bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		b.tokens += b.ratio
+		if b.tokens > retryBudgetTokens {
+			b.tokens = retryBudgetTokens
+		}
+	} else if b.tokens -= 1; b.tokens < 0 {
+		b.tokens = 0
+	}
+	retryBudgetGauge.WithLabelValues(b.ingress).Set(b.tokens)
+	return b.tokens > retryBudgetTokens/2
+}
+
+// retryTransport retries GET and HEAD requests that failed to reach the
+// backend, e.g. while its pods are being replaced, doubling the delay after
+// each attempt, as long as the retry budget of the Ingress allows.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	budget     *retryBudget
+}
+
+// withRetries wraps t in a retryTransport if the annotations of the Ingress
+// enable retries, reusing the retry budget of the previous update unless its
+// ratio changed. The budgets in use are added to next. c.mu must be held for
+// writing.
+func (c *controller) withRetries(t http.RoundTripper, ingress *v1.Ingress, next map[types.UID]*retryBudget) http.RoundTripper {
+	annotations := ingress.Annotations
+	rt := &retryTransport{next: t, baseDelay: 100 * time.Millisecond}
+	if v, ok := annotations[proxyMaxRetriesAnnotation]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("ignoring invalid %s annotation %q", proxyMaxRetriesAnnotation, v)
+		} else {
+			rt.maxRetries = n
+		}
+	}
+	if v, ok := annotations[proxyRetryBaseDelayAnnotation]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Printf("ignoring invalid %s annotation %q", proxyRetryBaseDelayAnnotation, v)
+		} else {
+			rt.baseDelay = d
+		}
+	}
+	if rt.maxRetries == 0 {
+		return t
+	}
+	ratio := 0.1
+	if v, ok := annotations[proxyRetryBudgetAnnotation]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			log.Printf("ignoring invalid %s annotation %q", proxyRetryBudgetAnnotation, v)
+		} else {
+			ratio = f
+		}
+	}
+	b, ok := c.retryBudgets[ingress.UID]
+	if !ok || b.ratio != ratio {
+		b = &retryBudget{
+			ratio:   ratio,
+			ingress: ingress.Namespace + "/" + ingress.Name,
+			tokens:  retryBudgetTokens,
+		}
+		retryBudgetGauge.WithLabelValues(b.ingress).Set(b.tokens)
+	}
+	next[ingress.UID] = b
+	rt.budget = b
+	return rt
+}
+
+// setRetryBudgets replaces the retry budgets in use, removing the metrics of
+// the unused ones. c.mu must be held for writing.
+func (c *controller) setRetryBudgets(next map[types.UID]*retryBudget) {
+	for uid, b := range c.retryBudgets {
+		if nb, ok := next[uid]; !ok || nb.ingress != b.ingress {
+			retryBudgetGauge.DeleteLabelValues(b.ingress)
+		}
+	}
+	c.retryBudgets = next
+}
+
+// retryHostKey is the context key of the function that picks the backend
+// address a request is sent to again after failing on another.
+type retryHostKey struct{}
+
+// withRetryHost returns a copy of r whose retries are sent to the addresses
+// pick returns.
+func withRetryHost(r *http.Request, pick func(failed string) string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), retryHostKey{}, pick))
+}
+
+// retryLogLimiter bounds how often retries are logged, as a failing backend
+// can cause many at once.
+var retryLogLimiter = rate.NewLimiter(rate.Every(time.Second), 5)
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.retryable(req) {
+		resp, err := t.next.RoundTrip(req)
+		t.budget.done(err == nil)
+		return resp, err
+	}
+	pick, _ := req.Context().Value(retryHostKey{}).(func(string) string)
+	delay := t.baseDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		allowed := t.budget.done(err == nil)
+		if err == nil || attempt == t.maxRetries {
+			return resp, err
+		}
+		if !allowed {
+			retriesThrottledTotal.Inc()
+			return resp, err
+		}
+		if retryLogLimiter.Allow() {
+			// The query may carry secrets.
+			log.Printf("retrying %s %s://%s%s after error: %v", req.Method, req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), err)
+		}
+		retriesTotal.Inc()
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		delay *= 2
+		// Transports must not modify the request they are given.
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		if pick != nil {
+			retry.URL.Host = pick(req.URL.Host)
+		}
+		req = retry
+	}
+}
+
+// retryable reports whether req is idempotent and can be sent again, which
+// requires its body, if any, to be rewindable.
+func (t *retryTransport) retryable(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
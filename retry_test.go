@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRetryPicksNewEndpoint(t *testing.T) {
+	p := &hostPath{
+		backend:   &url.URL{Scheme: "http", Host: "web.default.svc:80"},
+		endpoints: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+	}
+	var hosts, bodies []string
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hosts = append(hosts, req.URL.Host)
+		b, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(b))
+		if req.URL.Host == "10.0.0.1:8080" {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com")
+	ing.Annotations = map[string]string{
+		proxyMaxRetriesAnnotation:     "2",
+		proxyRetryBaseDelayAnnotation: "1ms",
+	}
+	rt := c.withRetries(next, ing, make(map[types.UID]*retryBudget))
+
+	req, err := http.NewRequest(http.MethodGet, "http://10.0.0.1:8080/search?token=secret", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = withRetryHost(req, p.retryHost)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := []string{"10.0.0.1:8080", "10.0.0.2:8080"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("attempts sent to %v, want %v", hosts, want)
+	}
+	for i, b := range bodies {
+		if b != "body" {
+			t.Errorf("attempt %d sent body %q, want %q", i, b, "body")
+		}
+	}
+	if req.URL.Host != "10.0.0.1:8080" {
+		t.Errorf("the original request was modified")
+	}
+
+	// Without another endpoint, the request is retried on the same one.
+	hosts = nil
+	p.endpoints = []string{"10.0.0.1:8080"}
+	if _, err := rt.RoundTrip(withRetryHost(req, p.retryHost)); err == nil {
+		t.Error("got no error from a failing endpoint")
+	}
+	if len(hosts) != 3 {
+		t.Errorf("got %d attempts, want 3", len(hosts))
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var attempts int
+	fail := true
+	next := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	c := newTestController(t, controllerConfig{})
+	ing := testIngress("app", "app.example.com")
+	ing.Annotations = map[string]string{
+		proxyMaxRetriesAnnotation:     "3",
+		proxyRetryBaseDelayAnnotation: "0s",
+	}
+	budgets := make(map[types.UID]*retryBudget)
+	rt := c.withRetries(next, ing, budgets)
+	c.setRetryBudgets(budgets)
+	send := func() int {
+		t.Helper()
+		attempts = 0
+		req, err := http.NewRequest(http.MethodGet, "http://web/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := rt.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+		return attempts
+	}
+
+	// With every attempt failing, the budget runs out after a few retries
+	// and the following requests aren't retried.
+	if n := send(); n != 4 {
+		t.Errorf("first failing request: got %d attempts, want 4", n)
+	}
+	for i := 0; i < 20; i++ {
+		if n := send(); n != 1 {
+			t.Fatalf("failing request %d with an exhausted budget: got %d attempts, want 1", i, n)
+		}
+	}
+
+	// Successful requests refill the budget, 0.1 tokens at a time.
+	fail = false
+	for i := 0; i < 100; i++ {
+		send()
+	}
+	fail = true
+	if n := send(); n != 4 {
+		t.Errorf("failing request after the budget refilled: got %d attempts, want 4", n)
+	}
+
+	reuse := func() *retryBudget {
+		next := make(map[types.UID]*retryBudget)
+		c.withRetries(http.DefaultTransport, ing, next)
+		c.setRetryBudgets(next)
+		return next[ing.UID]
+	}
+	b := budgets[ing.UID]
+	if reuse() != b {
+		t.Error("budget with the same ratio wasn't reused")
+	}
+	ing.Annotations[proxyRetryBudgetAnnotation] = "0.5"
+	if reuse() == b {
+		t.Error("budget was reused after its ratio changed")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"time"
+)
+
+// Modes of TIC_STATUS_ADDRESS, which picks the addresses of the nodes written
+// to the ingress status.
+const (
+	statusAddressMagicDNS = "magicdns"
+	statusAddressIP       = "ip"
+	statusAddressBoth     = "both"
+)
+
+func parseStatusAddress(v string) (string, error) {
+	switch v {
+	case "":
+		return statusAddressMagicDNS, nil
+	case statusAddressMagicDNS, statusAddressIP, statusAddressBoth:
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid TIC_STATUS_ADDRESS %q", v)
+}
+
+// statusEntries returns the status entries of a running node: its MagicDNS
+// name, its tailnet IPs or both. ok is false if they aren't known yet.
+func (c *controller) statusEntries(n *node) (entries []corev1.LoadBalancerIngress, ok bool) {
+	if !n.running {
+		return nil, false
+	}
+	if c.statusAddress != statusAddressIP {
+		if n.address == "" {
+			return nil, false
+		}
+		entries = append(entries, corev1.LoadBalancerIngress{Hostname: n.address})
+	}
+	if c.statusAddress == statusAddressIP || c.statusAddress == statusAddressBoth {
+		if len(n.ips) == 0 {
+			return nil, false
+		}
+		for _, ip := range n.ips {
+			entries = append(entries, corev1.LoadBalancerIngress{IP: ip})
+		}
+	}
+	return entries, true
+}
+
+// syncStatus writes the addresses of the nodes serving the hosts of each
+// ingress to its status, once they are all running, for those whose status is
+// out of date. c.mu must be held.
+func (c *controller) syncStatus() {
+	if c.client == nil || c.dryRun {
+		return
+	}
+	if updates := c.statusUpdates(); len(updates) > 0 {
+		go c.writeStatus(updates)
+	}
+}
+
+// statusUpdates returns copies of the ingresses whose status is out of date,
+// with the addresses of their nodes. c.mu must be held.
+func (c *controller) statusUpdates() []*v1.Ingress {
+	addresses := make(map[*v1.Ingress]map[string]corev1.LoadBalancerIngress)
+	pending := make(map[*v1.Ingress]bool)
+	for _, h := range c.hosts {
+		for _, ing := range h.ingresses {
+			if ing.Kind == httpRouteKind {
+				continue
+			}
+			if addresses[ing] == nil {
+				addresses[ing] = make(map[string]corev1.LoadBalancerIngress)
+			}
+			entries, ok := c.statusEntries(h.node)
+			if !ok {
+				pending[ing] = true
+				continue
+			}
+			// Names come before IPs, each sorted.
+			for _, e := range entries {
+				if e.Hostname != "" {
+					addresses[ing]["0"+e.Hostname] = e
+				} else {
+					addresses[ing]["1"+e.IP] = e
+				}
+			}
+		}
+	}
+	var updates []*v1.Ingress
+	for ing, addrs := range addresses {
+		if pending[ing] {
+			continue
+		}
+		lb := make([]corev1.LoadBalancerIngress, 0, len(addrs))
+		for _, k := range sortedKeys(addrs) {
+			lb = append(lb, addrs[k])
+		}
+		if equality.Semantic.DeepEqual(lb, ing.Status.LoadBalancer.Ingress) {
+			continue
+		}
+		// Ingresses come from the informer cache and must not be modified.
+		ing = ing.DeepCopy()
+		ing.Status.LoadBalancer.Ingress = lb
+		updates = append(updates, ing)
+	}
+	return updates
+}
+
+func (c *controller) writeStatus(ingresses []*v1.Ingress) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, ing := range ingresses {
+		_, err := c.client.NetworkingV1().Ingresses(ing.Namespace).UpdateStatus(ctx, ing, metav1.UpdateOptions{})
+		if err != nil {
+			c.recordError(errorKindStatus, "", "failed to update status of ingress %s/%s: %v", ing.Namespace, ing.Name, err)
+			continue
+		}
+		log.Printf("updated status of ingress %s/%s", ing.Namespace, ing.Name)
+	}
+}
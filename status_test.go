@@ -0,0 +1,54 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1"
+	"reflect"
+	"testing"
+)
+
+func TestStatusUpdates(t *testing.T) {
+	name := corev1.LoadBalancerIngress{Hostname: "app.tailnet.ts.net"}
+	ipv4 := corev1.LoadBalancerIngress{IP: "100.64.0.1"}
+	ipv6 := corev1.LoadBalancerIngress{IP: "fd7a:115c:a1e0::1"}
+	for _, tt := range []struct {
+		mode string
+		want []corev1.LoadBalancerIngress
+	}{
+		{statusAddressMagicDNS, []corev1.LoadBalancerIngress{name}},
+		{statusAddressIP, []corev1.LoadBalancerIngress{ipv4, ipv6}},
+		{statusAddressBoth, []corev1.LoadBalancerIngress{name, ipv4, ipv6}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			c := newTestController(t, controllerConfig{statusAddress: tt.mode})
+			ing := testIngress("app", "app.example.com")
+			n, err := c.newNode("app", false, timeouts{}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.hosts["app.example.com"] = &host{node: n, ingresses: []*v1.Ingress{ing}}
+
+			if got := c.statusUpdates(); len(got) != 0 {
+				t.Fatalf("got %d updates before the node is running, want none", len(got))
+			}
+			n.running = true
+			n.address = "app.tailnet.ts.net"
+			n.ips = []string{"fd7a:115c:a1e0::1", "100.64.0.1"}
+			got := c.statusUpdates()
+			if len(got) != 1 {
+				t.Fatalf("got %d updates, want 1", len(got))
+			}
+			if lb := got[0].Status.LoadBalancer.Ingress; !reflect.DeepEqual(lb, tt.want) {
+				t.Errorf("got status %v, want %v", lb, tt.want)
+			}
+			if len(ing.Status.LoadBalancer.Ingress) != 0 {
+				t.Error("the cached ingress was modified")
+			}
+
+			ing.Status.LoadBalancer.Ingress = tt.want
+			if got := c.statusUpdates(); len(got) != 0 {
+				t.Errorf("got %d updates for an up to date status, want none", len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"tailscale.com/client/tailscale"
+	"time"
+)
+
+const tagsAnnotation = "tailscale.com/tags"
+
+// newAPIClient returns a client for the Tailscale API using the OAuth client,
+// or else the API key, or nil without either.
+func newAPIClient(cfg controllerConfig) *tailscale.Client {
+	if cfg.oauthClientID != "" {
+		return newOAuthAPIClient(cfg.oauthClientID, cfg.oauthClientSecret, cfg.tailnet)
+	}
+	if cfg.tsAPIKey == "" {
+		return nil
+	}
+	tailscale.I_Acknowledge_This_API_Is_Unstable = true
+	return tailscale.NewClient(cfg.tailnet, tailscale.APIKey(cfg.tsAPIKey))
+}
+
+// parseTags parses a comma-separated list of ACL tags such as
+// "tag:ingress,tag:prod".
+func parseTags(v string) []string {
+	var tags []string
+	for _, t := range strings.Split(v, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// applyTags sets the ACL tags of a running node through the Tailscale API, as
+// tsnet can't request them itself.
+func (c *controller) applyTags(hostname, deviceID string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	if c.api == nil {
+		c.recordError(errorKindTags, hostname, "can't apply tags %v without TS_API_KEY or an OAuth client", tags)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.api.SetTags(ctx, deviceID, tags); err != nil {
+		c.recordError(errorKindTags, hostname, "failed to set tags %v: %v", tags, err)
+	}
+}
+
+// equalTags reports whether a and b hold the same tags in the same order.
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
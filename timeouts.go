@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	readHeaderTimeoutAnnotation = "tailscale.com/read-header-timeout"
+	readTimeoutAnnotation       = "tailscale.com/read-timeout"
+	writeTimeoutAnnotation      = "tailscale.com/write-timeout"
+	idleTimeoutAnnotation       = "tailscale.com/idle-timeout"
+)
+
+// timeouts holds the connection timeouts applied to the listeners of a host.
+// A zero value disables the corresponding timeout.
+type timeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+var defaultTimeouts = timeouts{
+	readHeader: 10 * time.Second,
+	idle:       2 * time.Minute,
+}
+
+// timeoutsFromEnv returns the default timeouts overridden by the TIC_*_TIMEOUT
+// environment variables.
+func timeoutsFromEnv() (timeouts, error) {
+	t := defaultTimeouts
+	for name, d := range map[string]*time.Duration{
+		"TIC_READ_HEADER_TIMEOUT": &t.readHeader,
+		"TIC_READ_TIMEOUT":        &t.read,
+		"TIC_WRITE_TIMEOUT":       &t.write,
+		"TIC_IDLE_TIMEOUT":        &t.idle,
+	} {
+		v, err := durationFromEnv(name, *d)
+		if err != nil {
+			return t, err
+		}
+		*d = v
+	}
+	return t, nil
+}
+
+// withAnnotations returns a copy of t with any timeouts set in the ingress
+// annotations applied.
+func (t timeouts) withAnnotations(annotations map[string]string) timeouts {
+	for name, d := range map[string]*time.Duration{
+		readHeaderTimeoutAnnotation: &t.readHeader,
+		readTimeoutAnnotation:       &t.read,
+		writeTimeoutAnnotation:      &t.write,
+		idleTimeoutAnnotation:       &t.idle,
+	} {
+		v, ok := annotations[name]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("ignoring invalid %s annotation %q: %v", name, v, err)
+			continue
+		}
+		*d = parsed
+	}
+	return t
+}
+
+func (t timeouts) applyToServer(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.readHeader
+	srv.ReadTimeout = t.read
+	srv.WriteTimeout = t.write
+	srv.IdleTimeout = t.idle
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"k8s.io/api/networking/v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsApplied(t *testing.T) {
+	t.Setenv("TIC_READ_TIMEOUT", "5s")
+	global, err := timeoutsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := timeouts{readHeader: 10 * time.Second, read: 5 * time.Second, idle: 2 * time.Minute}
+	if global != want {
+		t.Fatalf("got timeouts %+v from the environment, want %+v", global, want)
+	}
+
+	c := newTestController(t, controllerConfig{timeouts: global})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	ing.Annotations = map[string]string{
+		readHeaderTimeoutAnnotation: "3s",
+		writeTimeoutAnnotation:      "1m",
+		idleTimeoutAnnotation:       "invalid",
+	}
+	c.update(&update{ingresses: []*v1.Ingress{ing, testIngress("other", "other.example.com")}})
+	for host, want := range map[string]timeouts{
+		"app.example.com":   {readHeader: 3 * time.Second, read: 5 * time.Second, write: time.Minute, idle: 2 * time.Minute},
+		"other.example.com": global,
+	} {
+		c.mu.RLock()
+		n := c.hosts[host].node
+		c.mu.RUnlock()
+		srv := &http.Server{}
+		n.timeouts.applyToServer(srv)
+		got := timeouts{srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout}
+		if got != want {
+			t.Errorf("%s: got server timeouts %+v, want %+v", host, got, want)
+		}
+	}
+}
+
+func TestTimeoutsEnforced(t *testing.T) {
+	c := newTestController(t, controllerConfig{timeouts: defaultTimeouts})
+	ing := testIngress("app", "app.example.com", ingressPath("/", v1.PathTypePrefix, "web"))
+	ing.Annotations = map[string]string{
+		readHeaderTimeoutAnnotation: "100ms",
+		writeTimeoutAnnotation:      "200ms",
+	}
+	serveBackend(t, c, ing, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	c.mu.RLock()
+	n := c.hosts["app.example.com"].node
+	c.mu.RUnlock()
+	// Stand in for the server of the node.
+	srv := httptest.NewUnstartedServer(c.newHandler(n, fakeWhoIs{}))
+	n.timeouts.applyToServer(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func(path string) error {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "app.example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		return err
+	}
+	if err := get("/fast"); err != nil {
+		t.Errorf("fast request failed: %v", err)
+	}
+	// The response to a request outlasting the write timeout is cut.
+	if err := get("/slow"); err == nil {
+		t.Error("got a response from a backend slower than the write timeout")
+	}
+
+	// A client that doesn't finish sending its headers is disconnected.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app.example.com\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		// The server may answer with a 408 before closing.
+		_, err = io.ReadAll(conn)
+		if err != nil {
+			t.Errorf("connection with incomplete headers not closed: %v", err)
+		}
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("connection with incomplete headers not closed")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("connection with incomplete headers closed after %s", d)
+	}
+}
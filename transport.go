@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	backendProtocolAnnotation            = "tailscale.com/backend-protocol"
+	backendInsecureSkipVerifyAnnotation  = "tailscale.com/backend-insecure-skip-verify"
+	backendHTTPVersionAnnotation         = "tailscale.com/backend-http-version"
+	maxConnsAnnotation                   = "tailscale.com/max-conns"
+	proxyDialTimeoutAnnotation           = "tailscale.com/proxy-dial-timeout"
+	proxyResponseHeaderTimeoutAnnotation = "tailscale.com/proxy-response-header-timeout"
+	proxyIdleTimeoutAnnotation           = "tailscale.com/proxy-idle-timeout"
+)
+
+// backendScheme returns the URL scheme used to reach the backends of an
+// Ingress.
+func backendScheme(annotations map[string]string) string {
+	switch v := annotations[backendProtocolAnnotation]; strings.ToUpper(v) {
+	case "", "HTTP":
+		return "http"
+	case "HTTPS":
+		return "https"
+	default:
+		log.Printf("ignoring invalid %s annotation %q", backendProtocolAnnotation, v)
+		return "http"
+	}
+}
+
+// transportOptions describes how the proxy connects to a backend. Paths with
+// equal options share a transport, and with it a connection pool.
+type transportOptions struct {
+	forceHTTP1            bool
+	maxConnsPerHost       int
+	insecureSkipVerify    bool
+	dialTimeout           time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+}
+
+var defaultTransportOptions = transportOptions{
+	dialTimeout:           30 * time.Second,
+	responseHeaderTimeout: 30 * time.Second,
+	idleConnTimeout:       90 * time.Second,
+}
+
+// transportOptionsFromEnv returns the default transport options overridden
+// by the TS_PROXY_*_TIMEOUT environment variables.
+func transportOptionsFromEnv() (transportOptions, error) {
+	o := defaultTransportOptions
+	for name, d := range map[string]*time.Duration{
+		"TS_PROXY_DIAL_TIMEOUT":            &o.dialTimeout,
+		"TS_PROXY_RESPONSE_HEADER_TIMEOUT": &o.responseHeaderTimeout,
+		"TS_PROXY_IDLE_TIMEOUT":            &o.idleConnTimeout,
+	} {
+		v, err := durationFromEnv(name, *d)
+		if err != nil {
+			return o, err
+		}
+		*d = v
+	}
+	return o, nil
+}
+
+func (c *controller) transportOptionsFromAnnotations(annotations map[string]string) transportOptions {
+	o := c.transportOptions
+	for name, d := range map[string]*time.Duration{
+		proxyDialTimeoutAnnotation:           &o.dialTimeout,
+		proxyResponseHeaderTimeoutAnnotation: &o.responseHeaderTimeout,
+		proxyIdleTimeoutAnnotation:           &o.idleConnTimeout,
+	} {
+		v, ok := annotations[name]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("ignoring invalid %s annotation %q: %v", name, v, err)
+			continue
+		}
+		*d = parsed
+	}
+	switch v := annotations[backendHTTPVersionAnnotation]; v {
+	case "", "auto":
+	case "1.1":
+		o.forceHTTP1 = true
+	default:
+		log.Printf("ignoring invalid %s annotation %q", backendHTTPVersionAnnotation, v)
+	}
+	o.insecureSkipVerify = boolAnnotation(annotations, backendInsecureSkipVerifyAnnotation, false)
+	if v, ok := annotations[maxConnsAnnotation]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("ignoring invalid %s annotation %q", maxConnsAnnotation, v)
+		} else {
+			o.maxConnsPerHost = n
+		}
+	}
+	return o
+}
+
+func (c *controller) newTransport(o transportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxResponseHeaderBytes = c.maxResponseHeaderBytes
+	// Requests beyond the limit wait for a connection to become available.
+	t.MaxConnsPerHost = o.maxConnsPerHost
+	t.DialContext = (&net.Dialer{
+		Timeout:   o.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.ResponseHeaderTimeout = o.responseHeaderTimeout
+	t.IdleConnTimeout = o.idleConnTimeout
+	if o.insecureSkipVerify {
+		// Many in-cluster services use self-signed certificates.
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if o.forceHTTP1 {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil, empty map disables the automatic HTTP/2 upgrade.
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return t
+}
+
+// transport returns the shared transport for the given options, creating it if
+// needed. c.mu must be held for writing.
+func (c *controller) transport(o transportOptions) *http.Transport {
+	t, ok := c.transports[o]
+	if !ok {
+		t = c.newTransport(o)
+		c.transports[o] = t
+	}
+	return t
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendHTTPVersion(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		version string
+		want    string
+	}{
+		{"", "HTTP/2.0"},
+		{"auto", "HTTP/2.0"},
+		{"1.1", "HTTP/1.1"},
+	} {
+		c := newTestController(t, controllerConfig{})
+		o := c.transportOptionsFromAnnotations(map[string]string{
+			backendHTTPVersionAnnotation:        tt.version,
+			backendInsecureSkipVerifyAnnotation: "true",
+		})
+		client := &http.Client{Transport: c.newTransport(o)}
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatalf("version %q: %v", tt.version, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := string(b); got != tt.want {
+			t.Errorf("version %q: backend saw %s, want %s", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Large", strings.Repeat("a", 8<<10))
+	}))
+	defer backend.Close()
+
+	for _, tt := range []struct {
+		limit  int64
+		wantOK bool
+	}{
+		{4 << 10, false},
+		{64 << 10, true},
+		{0, true},
+	} {
+		c := newTestController(t, controllerConfig{maxResponseHeaderBytes: tt.limit})
+		client := &http.Client{Transport: c.newTransport(c.transportOptions)}
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != tt.wantOK {
+			t.Errorf("limit %d: got error %v, want success %t", tt.limit, err, tt.wantOK)
+		}
+	}
+
+	t.Setenv("DRY_RUN", "true")
+	t.Setenv("TIC_MAX_RESPONSE_HEADER_BYTES", "-1")
+	if _, err := configFromEnv(); err == nil {
+		t.Error("got no error for a negative TIC_MAX_RESPONSE_HEADER_BYTES")
+	}
+	t.Setenv("TIC_MAX_RESPONSE_HEADER_BYTES", "65536")
+	cfg, err := configFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.maxResponseHeaderBytes != 65536 {
+		t.Errorf("got maxResponseHeaderBytes %d, want 65536", cfg.maxResponseHeaderBytes)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	var conns atomic.Int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	backend.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	c := newTestController(t, controllerConfig{})
+	for _, v := range []string{"-1", "invalid"} {
+		if o := c.transportOptionsFromAnnotations(map[string]string{maxConnsAnnotation: v}); o.maxConnsPerHost != 0 {
+			t.Errorf("got %d connections for annotation %q, want no limit", o.maxConnsPerHost, v)
+		}
+	}
+	o := c.transportOptionsFromAnnotations(map[string]string{maxConnsAnnotation: "2"})
+	client := &http.Client{Transport: c.newTransport(o)}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(backend.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if got := maxInFlight.Load(); got != 2 {
+		t.Errorf("got at most %d concurrent requests, want 2", got)
+	}
+	if got := conns.Load(); got > 2 {
+		t.Errorf("got %d connections, want at most 2", got)
+	}
+}
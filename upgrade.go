@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// isUpgrade reports whether r asks to switch protocols, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeResponseWriter clears the deadlines of the connection once it is
+// hijacked for a protocol switch, so that the read and write timeouts of the
+// server don't cut long-lived WebSocket connections.
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w upgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to clear deadline: %w", err)
+	}
+	return conn, brw, nil
+}
+
+func (w upgradeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w upgradeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}